@@ -0,0 +1,247 @@
+package p2pforwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var (
+	// ErrInvalidAlias = error "Alias must not be empty, contain spaces or be a peer id"
+	ErrInvalidAlias = errors.New("Alias must not be empty, contain spaces or be a peer id")
+	// ErrAliasNotFound = error "Alias is not found in address book"
+	ErrAliasNotFound = errors.New("Alias is not found in address book")
+	// ErrAddrPeerMismatch = error "Multiaddr contains id of other peer"
+	ErrAddrPeerMismatch = errors.New("Multiaddr contains id of other peer")
+)
+
+// AddressBookFile sets file, where aliases of peers are stored.
+// By default file "addressbook" in user's config directory is used.
+// If path is empty, address book is kept only in memory.
+func AddressBookFile(path string) Option {
+	return func(cfg *config) error {
+		cfg.addressBookCustom = true
+		cfg.addressBookPath = path
+		return nil
+	}
+}
+
+// Alias - entry of address book, see Forwarder.SetAlias
+type Alias struct {
+	Name   string
+	PeerID string
+	Addrs  []string
+}
+
+type addressBook struct {
+	path    string
+	entries map[string]addressBookEntry // alias -> entry
+
+	mux sync.Mutex
+}
+
+type addressBookEntry struct {
+	ID    string   `json:"id"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// loadAddressBook reads address book at path, if it exists. Empty path means, that address book is not persisted.
+func loadAddressBook(path string) (*addressBook, error) {
+	ab := &addressBook{
+		path:    path,
+		entries: make(map[string]addressBookEntry),
+	}
+
+	if path == "" {
+		return ab, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ab, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &ab.entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return ab, nil
+}
+
+// save must be called with ab.mux locked
+func (ab *addressBook) save() error {
+	if ab.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(ab.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(ab.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(ab.path, b, 0644)
+}
+
+// addKnownAddrs adds multiaddrs from address book to peerstore, so peers are dialed without lookup
+func (f *Forwarder) addKnownAddrs() {
+	f.addressBook.mux.Lock()
+	defer f.addressBook.mux.Unlock()
+
+	for alias, entry := range f.addressBook.entries {
+		peerid, maddrs, err := parseAliasEntry(entry.ID, entry.Addrs)
+		if err != nil {
+			f.emit(EventError{Err: errors.New("Address book entry " + alias + ": " + err.Error())})
+			continue
+		}
+
+		f.host.Peerstore().AddAddrs(peerid, maddrs, peerstore.PermanentAddrTTL)
+	}
+}
+
+// parseAliasEntry decodes peer id and its multiaddrs. Multiaddrs may end with /p2p/ID of the same peer.
+func parseAliasEntry(id string, addrs []string) (peer.ID, []ma.Multiaddr, error) {
+	peerid, err := peer.IDB58Decode(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	maddrs := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return "", nil, err
+		}
+
+		transport, addrID := peer.SplitAddr(maddr)
+		if addrID != "" && addrID != peerid {
+			return "", nil, ErrAddrPeerMismatch
+		}
+		if transport == nil {
+			continue
+		}
+
+		maddrs = append(maddrs, transport)
+	}
+
+	return peerid, maddrs, nil
+}
+
+// SetAlias saves alias of peer with passed id and its known multiaddrs, e.g. "/ip4/203.0.113.7/tcp/4001", into address book.
+// Alias may be used instead of id in Connect and other methods, which take peer id.
+// Existing alias with the same name is replaced.
+func (f *Forwarder) SetAlias(alias string, id string, addrs ...string) error {
+	if alias == "" || strings.ContainsAny(alias, " \t\r\n") {
+		return ErrInvalidAlias
+	}
+	if _, err := peer.IDB58Decode(alias); err == nil {
+		return ErrInvalidAlias
+	}
+
+	peerid, maddrs, err := parseAliasEntry(id, addrs)
+	if err != nil {
+		return err
+	}
+
+	f.addressBook.mux.Lock()
+	defer f.addressBook.mux.Unlock()
+
+	old, existed := f.addressBook.entries[alias]
+
+	f.addressBook.entries[alias] = addressBookEntry{ID: peerid.Pretty(), Addrs: addrs}
+
+	err = f.addressBook.save()
+	if err != nil {
+		if existed {
+			f.addressBook.entries[alias] = old
+		} else {
+			delete(f.addressBook.entries, alias)
+		}
+		return err
+	}
+
+	f.host.Peerstore().AddAddrs(peerid, maddrs, peerstore.PermanentAddrTTL)
+
+	return nil
+}
+
+// RemoveAlias removes alias from address book. Connections made with alias are kept.
+func (f *Forwarder) RemoveAlias(alias string) error {
+	f.addressBook.mux.Lock()
+	defer f.addressBook.mux.Unlock()
+
+	old, ok := f.addressBook.entries[alias]
+	if !ok {
+		return ErrAliasNotFound
+	}
+
+	delete(f.addressBook.entries, alias)
+
+	err := f.addressBook.save()
+	if err != nil {
+		f.addressBook.entries[alias] = old
+		return err
+	}
+
+	return nil
+}
+
+// Aliases returns entries of address book sorted by alias
+func (f *Forwarder) Aliases() []Alias {
+	f.addressBook.mux.Lock()
+	aliases := make([]Alias, 0, len(f.addressBook.entries))
+	for name, entry := range f.addressBook.entries {
+		aliases = append(aliases, Alias{
+			Name:   name,
+			PeerID: entry.ID,
+			Addrs:  append([]string(nil), entry.Addrs...),
+		})
+	}
+	f.addressBook.mux.Unlock()
+
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].Name < aliases[j].Name
+	})
+
+	return aliases
+}
+
+// ResolvePeer returns id of peer, which is aliased by id in address book, or id itself, if it is peer id
+func (f *Forwarder) ResolvePeer(id string) (string, error) {
+	peerid, err := f.resolvePeerID(id)
+	if err != nil {
+		return "", err
+	}
+
+	return peerid.Pretty(), nil
+}
+
+// resolvePeerID returns peer id, which is aliased by id, or decodes id itself
+func (f *Forwarder) resolvePeerID(id string) (peer.ID, error) {
+	f.addressBook.mux.Lock()
+	entry, ok := f.addressBook.entries[id]
+	f.addressBook.mux.Unlock()
+
+	if ok {
+		id = entry.ID
+	}
+
+	return peer.IDB58Decode(id)
+}
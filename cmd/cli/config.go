@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	p2pforwarder "github.com/nickname32/p2p-forwarder"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// fileConfig - config file passed with -config flag, e.g.
+//
+//	identity: /home/user/forwarder.key
+//	open:
+//	  - network: tcp
+//	    port: 22
+//	    name: ssh
+//	    allow: [ID]
+//	connect:
+//	  - id: ID
+//	    services: [minecraft]
+//	profiles:
+//	  work:
+//	    swarmkey: /home/user/work.key
+//	    connect:
+//	      - id: ID
+//	        ports: ["tcp:5432"]
+//	        map: ["tcp:5432:15432"]
+//
+// Profile selected with -profile flag overrides network options and adds ports and peers to top level ones.
+// On SIGHUP config is read again, ports and connections are changed to match it.
+type fileConfig struct {
+	Identity       string   `yaml:"identity"`
+	SwarmKey       string   `yaml:"swarmkey"`
+	LAN            bool     `yaml:"lan"`
+	ListenAddrs    []string `yaml:"listen"`
+	BootstrapPeers []string `yaml:"bootstrap"`
+	Relays         []string `yaml:"relays"`
+	Persist        bool     `yaml:"persist"`
+
+	Open    []configPort `yaml:"open"`
+	Connect []configPeer `yaml:"connect"`
+
+	Profiles map[string]*fileConfig `yaml:"profiles"`
+}
+
+type configPort struct {
+	Network     string   `yaml:"network"`
+	Port        uint16   `yaml:"port"`
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Target      string   `yaml:"target"`
+	Allow       []string `yaml:"allow"`
+	Deny        []string `yaml:"deny"`
+}
+
+type configPeer struct {
+	ID       string   `yaml:"id"`
+	IP       string   `yaml:"ip"`
+	Offset   *int     `yaml:"offset"`
+	Map      []string `yaml:"map"` // NETWORK:REMOTE_PORT:LOCAL_PORT
+	Services []string `yaml:"services"`
+	Ports    []string `yaml:"ports"` // NETWORK:PORT
+	UDPMux   bool     `yaml:"udpmux"`
+}
+
+// Config, which is currently applied, guarded by stateMux
+var (
+	appliedConfig *fileConfig
+	appliedPorts  = make(map[string]configPort)
+	appliedPeers  = make(map[string]configPeer)
+)
+
+// loadConfig reads config file at path and merges selected profile into it
+func loadConfig(path string, profile string) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(fileConfig)
+	err = yaml.UnmarshalStrict(b, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := cfg.Profiles
+	cfg.Profiles = nil
+
+	if profile == "" {
+		return cfg, nil
+	}
+
+	p := profiles[profile]
+	if p == nil {
+		return nil, errors.New("Profile " + profile + " is not found in " + path)
+	}
+	if len(p.Profiles) != 0 {
+		return nil, errors.New("Profile " + profile + " must not contain profiles")
+	}
+
+	if p.Identity != "" {
+		cfg.Identity = p.Identity
+	}
+	if p.SwarmKey != "" {
+		cfg.SwarmKey = p.SwarmKey
+	}
+	if p.LAN {
+		cfg.LAN = true
+	}
+	if p.Persist {
+		cfg.Persist = true
+	}
+	if len(p.ListenAddrs) != 0 {
+		cfg.ListenAddrs = p.ListenAddrs
+	}
+	if len(p.BootstrapPeers) != 0 {
+		cfg.BootstrapPeers = p.BootstrapPeers
+	}
+	if len(p.Relays) != 0 {
+		cfg.Relays = p.Relays
+	}
+
+	cfg.Open = append(cfg.Open, p.Open...)
+	cfg.Connect = append(cfg.Connect, p.Connect...)
+
+	return cfg, nil
+}
+
+// options returns forwarder options of config
+func (cfg *fileConfig) options() []p2pforwarder.Option {
+	var opts []p2pforwarder.Option
+
+	if cfg.Identity != "" {
+		opts = append(opts, p2pforwarder.IdentityFromFile(cfg.Identity))
+	}
+	if cfg.SwarmKey != "" {
+		opts = append(opts, p2pforwarder.PrivateNetworkFromFile(cfg.SwarmKey))
+	}
+	if cfg.LAN {
+		opts = append(opts, p2pforwarder.LocalNetworkOnly())
+	}
+	if len(cfg.ListenAddrs) != 0 {
+		opts = append(opts, p2pforwarder.ListenAddrs(cfg.ListenAddrs...))
+	}
+	if len(cfg.BootstrapPeers) != 0 {
+		opts = append(opts, p2pforwarder.BootstrapPeers(cfg.BootstrapPeers...))
+	}
+	if len(cfg.Relays) != 0 {
+		opts = append(opts, p2pforwarder.Relays(cfg.Relays...))
+	}
+	if cfg.Persist {
+		opts = append(opts, p2pforwarder.PersistState(""))
+	}
+
+	return opts
+}
+
+// sameNetwork reports if network options of configs are equal
+func (cfg *fileConfig) sameNetwork(other *fileConfig) bool {
+	a := *cfg
+	b := *other
+
+	a.Open, a.Connect, a.Profiles = nil, nil, nil
+	b.Open, b.Connect, b.Profiles = nil, nil, nil
+
+	return reflect.DeepEqual(a, b)
+}
+
+func (p configPort) key() string {
+	return strings.ToLower(p.Network) + ":" + strconv.Itoa(int(p.Port))
+}
+
+// options returns port options of p, aliases in allow and deny lists are resolved to peer ids
+func (p configPort) options() ([]p2pforwarder.PortOption, error) {
+	var opts []p2pforwarder.PortOption
+
+	if p.Target != "" {
+		opts = append(opts, p2pforwarder.Target(p.Target))
+	}
+	if len(p.Allow) != 0 {
+		ids, err := resolvePeers(p.Allow)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, p2pforwarder.AllowPeers(ids...))
+	}
+	if len(p.Deny) != 0 {
+		ids, err := resolvePeers(p.Deny)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, p2pforwarder.DenyPeers(ids...))
+	}
+	if p.Name != "" || p.Description != "" {
+		opts = append(opts, p2pforwarder.Service(p.Name, p.Description))
+	}
+
+	return opts, nil
+}
+
+// matches reports if opened port has the same options as p
+func (p configPort) matches(op *p2pforwarder.OpenedPort) bool {
+	if op.Target != p.Target || op.Name != p.Name || op.Description != p.Description {
+		return false
+	}
+
+	return samePeers(op.AllowedPeers, p.Allow) && samePeers(op.DeniedPeers, p.Deny)
+}
+
+// samePeers reports if ids and configured ids denote the same set of peers, ids must be sorted
+func samePeers(ids []string, configured []string) bool {
+	resolved, err := resolvePeers(configured)
+	if err != nil {
+		return false
+	}
+	sort.Strings(resolved)
+
+	return reflect.DeepEqual(ids, resolved)
+}
+
+// args returns peer's options in format of parseConnectOptions.
+// Peers of config are connected in background and retried, until they are reachable.
+func (p configPeer) args() []string {
+	args := []string{"retry=true"}
+
+	if p.IP != "" {
+		args = append(args, "ip="+p.IP)
+	}
+	if p.Offset != nil {
+		args = append(args, "offset="+strconv.Itoa(*p.Offset))
+	}
+	for _, m := range p.Map {
+		args = append(args, "map="+m)
+	}
+	if len(p.Services) != 0 {
+		args = append(args, "services="+strings.Join(p.Services, ","))
+	}
+	if len(p.Ports) != 0 {
+		args = append(args, "ports="+strings.Join(p.Ports, ","))
+	}
+	if p.UDPMux {
+		args = append(args, "udpmux=true")
+	}
+
+	return args
+}
+
+// sameExceptFilter reports if peers' options differ in ports and services only
+func (p configPeer) sameExceptFilter(other configPeer) bool {
+	p.Ports, p.Services = nil, nil
+	other.Ports, other.Services = nil, nil
+
+	return reflect.DeepEqual(p, other)
+}
+
+// setFilter applies ports and services of peer to its connection
+func (p configPeer) setFilter() error {
+	var pf p2pforwarder.PortFilter
+
+	if len(p.Services) != 0 {
+		err := parsePortFilterOption(&pf, "services", strings.Join(p.Services, ","))
+		if err != nil {
+			return err
+		}
+	}
+	if len(p.Ports) != 0 {
+		err := parsePortFilterOption(&pf, "ports", strings.Join(p.Ports, ","))
+		if err != nil {
+			return err
+		}
+	}
+
+	return fwr.SetPortFilter(p.ID, pf)
+}
+
+// applyConfig opens ports and connects to peers of cfg, which are not applied yet,
+// and closes ports and connections, which were removed from cfg or changed in it.
+// It must be called with stateMux locked.
+func applyConfig(cfg *fileConfig) {
+	if appliedConfig != nil && !cfg.sameNetwork(appliedConfig) {
+		zap.L().Warn("Network options in config are changed, restart is required to apply them")
+	}
+	appliedConfig = cfg
+
+	// Ports and connections could be closed by commands meanwhile
+	for key, p := range appliedPorts {
+		openPorts := openTCPPorts
+		if strings.ToLower(p.Network) == "udp" {
+			openPorts = openUDPPorts
+		}
+		if openPorts[p.Port] == nil {
+			delete(appliedPorts, key)
+		}
+	}
+	for id := range appliedPeers {
+		if connections[peerKey(id)] == nil {
+			delete(appliedPeers, id)
+		}
+	}
+
+	ports := make(map[string]configPort, len(cfg.Open))
+	for _, p := range cfg.Open {
+		ports[p.key()] = p
+	}
+	peers := make(map[string]configPeer, len(cfg.Connect))
+	for _, p := range cfg.Connect {
+		peers[p.ID] = p
+	}
+
+	for key, old := range appliedPorts {
+		if p, ok := ports[key]; ok && reflect.DeepEqual(p, old) {
+			continue
+		}
+
+		delete(appliedPorts, key)
+
+		err := closePort(old.Network, strconv.Itoa(int(old.Port)))
+		if err != nil {
+			zap.S().Error(err)
+		}
+	}
+	for id, old := range appliedPeers {
+		p, ok := peers[id]
+		if ok && reflect.DeepEqual(p, old) {
+			continue
+		}
+
+		// Filter is changed without reconnecting
+		if ok && p.sameExceptFilter(old) {
+			err := p.setFilter()
+			if err == nil {
+				appliedPeers[id] = p
+				continue
+			}
+			zap.S().Error(err)
+		}
+
+		delete(appliedPeers, id)
+
+		err := disconnect(id)
+		if err != nil {
+			zap.S().Error(err)
+		}
+	}
+
+	for key, p := range ports {
+		if _, ok := appliedPorts[key]; ok {
+			continue
+		}
+
+		// Port restored from previous run is taken over by config, it is opened again, if its options differ
+		if op := restoredPort(p.Network, p.Port); op != nil {
+			if p.matches(op) {
+				delete(restoredPorts, key)
+				appliedPorts[key] = p
+				continue
+			}
+		}
+
+		opts, err := p.options()
+		if err != nil {
+			zap.S().Error(err)
+			continue
+		}
+
+		releaseRestoredPort(p.Network, strconv.Itoa(int(p.Port)))
+
+		err = openPortWithOptions(p.Network, p.Port, opts...)
+		if err != nil {
+			zap.S().Error(err)
+			continue
+		}
+
+		appliedPorts[key] = p
+	}
+	for id, p := range peers {
+		if _, ok := appliedPeers[id]; ok {
+			continue
+		}
+
+		_, err := connect(id, p.args())
+		if err != nil {
+			zap.S().Error(err)
+			continue
+		}
+
+		appliedPeers[id] = p
+	}
+}
+
+// reloadConfig reads config again and applies it
+func reloadConfig(path string, profile string) {
+	zap.L().Info("Reloading config " + path)
+
+	cfg, err := loadConfig(path, profile)
+	if err != nil {
+		zap.S().Error(err)
+		return
+	}
+
+	stateMux.Lock()
+	applyConfig(cfg)
+	stateMux.Unlock()
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/sparkymat/appdir"
+	"go.uber.org/zap"
+)
+
+// Control API is HTTP with JSON bodies served on unix socket:
+//
+//	GET  /status     - controlStatus
+//	GET  /list       - controlList
+//	POST /open       - controlRequest with Network, Port and Options, e.g. ["target=HOST:PORT", "name=NAME"]
+//	POST /close      - controlRequest with Network and Port
+//	POST /connect    - controlRequest with ID and Options, e.g. ["ip=IP", "services=NAME"]
+//	POST /disconnect - controlRequest with ID
+//	GET  /aliases    - controlAliases
+//	POST /alias      - controlRequest with Alias, ID and Options, which are known multiaddrs of peer
+//	POST /unalias    - controlRequest with Alias
+//
+// Options are the same as in cli commands. Errors are returned as controlError.
+
+// controlRequest - body of POST requests of control API
+type controlRequest struct {
+	ID      string   `json:"id,omitempty"`
+	Alias   string   `json:"alias,omitempty"`
+	Network string   `json:"network,omitempty"`
+	Port    uint16   `json:"port,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+type controlError struct {
+	Error string `json:"error"`
+}
+
+type controlOK struct {
+	ListenIP string `json:"listen_ip,omitempty"`
+}
+
+type controlStatus struct {
+	ID          string `json:"id"`
+	Connections int    `json:"connections"`
+	OpenPorts   int    `json:"open_ports"`
+}
+
+type controlList struct {
+	Connections []controlConnection `json:"connections"`
+	OpenPorts   []controlPort       `json:"open_ports"`
+}
+
+type controlConnection struct {
+	ID       string              `json:"id"`
+	ListenIP string              `json:"listen_ip"`
+	Ports    []controlRemotePort `json:"ports"`
+}
+
+type controlRemotePort struct {
+	Network     string `json:"network"`
+	Port        uint16 `json:"port"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	LocalAddr   string `json:"local_addr,omitempty"`
+}
+
+type controlAliases struct {
+	Aliases []controlAlias `json:"aliases"`
+}
+
+type controlAlias struct {
+	Alias string   `json:"alias"`
+	ID    string   `json:"id"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+type controlPort struct {
+	Network string `json:"network"`
+	Port    uint16 `json:"port"`
+}
+
+// defaultControlPath returns path of control socket, which is used, if -control flag is not set
+func defaultControlPath() (string, error) {
+	return appdir.AppInfo{
+		Author: "nickname32",
+		Name:   "P2P Forwarder",
+	}.ConfigPath("control.sock")
+}
+
+// startControlServer serves control API on unix socket at path
+func startControlServer(path string) (stop func(), err error) {
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// Socket may be left by previous run, which was not shut down properly,
+	// it is removed only if it is a socket and nobody listens on it
+	fi, err := os.Lstat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("Control socket path " + path + " exists and is not a socket")
+		}
+
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, errors.New("Control socket " + path + " is used by other running forwarder")
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ln, err := listenPrivateUnix(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", controlHandler(http.MethodGet, handleStatus))
+	mux.HandleFunc("/list", controlHandler(http.MethodGet, handleList))
+	mux.HandleFunc("/open", controlHandler(http.MethodPost, handleOpen))
+	mux.HandleFunc("/close", controlHandler(http.MethodPost, handleClose))
+	mux.HandleFunc("/connect", controlHandler(http.MethodPost, handleConnect))
+	mux.HandleFunc("/disconnect", controlHandler(http.MethodPost, handleDisconnect))
+	mux.HandleFunc("/aliases", controlHandler(http.MethodGet, handleAliases))
+	mux.HandleFunc("/alias", controlHandler(http.MethodPost, handleAlias))
+	mux.HandleFunc("/unalias", controlHandler(http.MethodPost, handleUnalias))
+
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		err := server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			zap.S().Error(err)
+		}
+	}()
+
+	return func() {
+		server.Shutdown(context.Background())
+		os.Remove(path)
+	}, nil
+}
+
+// listenPrivateUnix listens on unix socket, which only owner may connect to.
+// Socket is created in private directory and moved to path after its permissions are set,
+// so it is never accessible to others.
+func listenPrivateUnix(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "control.sock")
+
+	ln, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// Socket file is removed by rename, not by listener
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpPath, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// controlHandler decodes request, calls fn with stateMux locked and encodes its result
+func controlHandler(method string, fn func(req *controlRequest) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeControlResponse(w, http.StatusMethodNotAllowed, controlError{Error: "Method " + r.Method + " is not allowed"})
+			return
+		}
+
+		req := new(controlRequest)
+		if r.Method == http.MethodPost {
+			err := json.NewDecoder(r.Body).Decode(req)
+			if err != nil {
+				writeControlResponse(w, http.StatusBadRequest, controlError{Error: err.Error()})
+				return
+			}
+		}
+
+		stateMux.Lock()
+		resp, err := fn(req)
+		stateMux.Unlock()
+
+		if err != nil {
+			writeControlResponse(w, http.StatusBadRequest, controlError{Error: err.Error()})
+			return
+		}
+
+		writeControlResponse(w, http.StatusOK, resp)
+	}
+}
+
+func writeControlResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		zap.S().Error(err)
+	}
+}
+
+func handleStatus(_ *controlRequest) (interface{}, error) {
+	return controlStatus{
+		ID:          fwr.ID(),
+		Connections: len(connections),
+		OpenPorts:   len(openTCPPorts) + len(openUDPPorts),
+	}, nil
+}
+
+func handleList(_ *controlRequest) (interface{}, error) {
+	list := controlList{
+		Connections: make([]controlConnection, 0, len(connections)),
+		OpenPorts:   make([]controlPort, 0, len(openTCPPorts)+len(openUDPPorts)),
+	}
+
+	for id, conn := range connections {
+		c := controlConnection{
+			ID:       id,
+			ListenIP: conn.listenip,
+			Ports:    []controlRemotePort{},
+		}
+
+		// Error means, that connection was cancelled meanwhile
+		ports, _ := fwr.RemotePorts(id)
+		for _, port := range ports {
+			c.Ports = append(c.Ports, controlRemotePort{
+				Network:     port.Network,
+				Port:        port.Port,
+				Name:        port.Name,
+				Description: port.Description,
+				LocalAddr:   port.LocalAddr,
+			})
+		}
+
+		list.Connections = append(list.Connections, c)
+	}
+	sort.Slice(list.Connections, func(i, j int) bool {
+		return list.Connections[i].ID < list.Connections[j].ID
+	})
+
+	for port := range openTCPPorts {
+		list.OpenPorts = append(list.OpenPorts, controlPort{Network: "tcp", Port: port})
+	}
+	for port := range openUDPPorts {
+		list.OpenPorts = append(list.OpenPorts, controlPort{Network: "udp", Port: port})
+	}
+	sort.Slice(list.OpenPorts, func(i, j int) bool {
+		if list.OpenPorts[i].Network != list.OpenPorts[j].Network {
+			return list.OpenPorts[i].Network < list.OpenPorts[j].Network
+		}
+		return list.OpenPorts[i].Port < list.OpenPorts[j].Port
+	})
+
+	return list, nil
+}
+
+func handleOpen(req *controlRequest) (interface{}, error) {
+	if req.Port == 0 {
+		return nil, errors.New("Port number is not specified")
+	}
+
+	err := openPort(req.Network, strconv.Itoa(int(req.Port)), req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	return controlOK{}, nil
+}
+
+func handleClose(req *controlRequest) (interface{}, error) {
+	err := closePort(req.Network, strconv.Itoa(int(req.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	return controlOK{}, nil
+}
+
+func handleConnect(req *controlRequest) (interface{}, error) {
+	listenip, err := connect(req.ID, req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	return controlOK{ListenIP: listenip}, nil
+}
+
+func handleDisconnect(req *controlRequest) (interface{}, error) {
+	err := disconnect(req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return controlOK{}, nil
+}
+
+func handleAliases(_ *controlRequest) (interface{}, error) {
+	aliases := fwr.Aliases()
+
+	resp := controlAliases{Aliases: make([]controlAlias, 0, len(aliases))}
+	for _, alias := range aliases {
+		resp.Aliases = append(resp.Aliases, controlAlias{
+			Alias: alias.Name,
+			ID:    alias.PeerID,
+			Addrs: alias.Addrs,
+		})
+	}
+
+	return resp, nil
+}
+
+func handleAlias(req *controlRequest) (interface{}, error) {
+	err := fwr.SetAlias(req.Alias, req.ID, req.Options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return controlOK{}, nil
+}
+
+func handleUnalias(req *controlRequest) (interface{}, error) {
+	err := fwr.RemoveAlias(req.Alias)
+	if err != nil {
+		return nil, err
+	}
+
+	return controlOK{}, nil
+}
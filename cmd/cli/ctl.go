@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const ctlUsage = `Usage: p2p-forwarder ctl [-control PATH] COMMAND [--json]
+
+Commands:
+  status
+  ls
+  open TCP_OR_UDP PORT [target=HOST:PORT allow=ID,ID deny=ID,ID name=NAME desc=DESCRIPTION]
+  close TCP_OR_UDP PORT
+  connect ID [ip=LISTEN_IP offset=PORT_OFFSET map=TCP_OR_UDP:REMOTE_PORT:LOCAL_PORT udpmux=true retry=true services=NAME,NAME ports=TCP_OR_UDP:PORT]
+  disconnect ID
+  aliases
+  alias ALIAS ID [MULTIADDR...]
+  unalias ALIAS
+
+Alias can be used instead of ID.
+--json prints raw response of control API.
+`
+
+// runCtl executes ctl subcommand against running forwarder and returns exit code
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, ctlUsage)
+	}
+	controlPath := fs.String("control", "", "Path to unix socket of control API.")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	// --json may be passed anywhere after command
+	var (
+		params     []string
+		jsonOutput bool
+	)
+	for _, arg := range fs.Args() {
+		if arg == "-json" || arg == "--json" {
+			jsonOutput = true
+			continue
+		}
+		params = append(params, arg)
+	}
+
+	if len(params) == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if *controlPath == "" {
+		*controlPath, err = defaultControlPath()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	c := &ctlClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", *controlPath)
+				},
+			},
+		},
+	}
+
+	cmd, params := strings.ToLower(params[0]), params[1:]
+
+	var (
+		path   string
+		req    *controlRequest
+		resp   interface{}
+		printf func()
+	)
+	switch cmd {
+	case "status":
+		status := new(controlStatus)
+		path, resp = "/status", status
+		printf = func() {
+			fmt.Println("ID:", status.ID)
+			fmt.Println("Connections:", status.Connections)
+			fmt.Println("Open ports:", status.OpenPorts)
+		}
+	case "ls", "list":
+		list := new(controlList)
+		path, resp = "/list", list
+		printf = func() { printCtlList(list) }
+	case "open", "close":
+		if len(params) < 2 {
+			fs.Usage()
+			return 2
+		}
+
+		port, err := strconv.ParseUint(params[1], 10, 16)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		req = &controlRequest{Network: strings.ToLower(params[0]), Port: uint16(port), Options: params[2:]}
+		path, resp = "/"+cmd, new(controlOK)
+		printf = func() {}
+	case "connect":
+		if len(params) < 1 {
+			fs.Usage()
+			return 2
+		}
+
+		ok := new(controlOK)
+		req = &controlRequest{ID: params[0], Options: params[1:]}
+		path, resp = "/connect", ok
+		printf = func() {
+			fmt.Println("Connections to " + params[0] + "'s ports are listened on " + ok.ListenIP)
+		}
+	case "disconnect":
+		if len(params) < 1 {
+			fs.Usage()
+			return 2
+		}
+
+		req = &controlRequest{ID: params[0]}
+		path, resp = "/disconnect", new(controlOK)
+		printf = func() {}
+	case "aliases":
+		aliases := new(controlAliases)
+		path, resp = "/aliases", aliases
+		printf = func() {
+			for _, alias := range aliases.Aliases {
+				fmt.Println(strings.Join(append([]string{alias.Alias, alias.ID}, alias.Addrs...), " "))
+			}
+		}
+	case "alias":
+		if len(params) < 2 {
+			fs.Usage()
+			return 2
+		}
+
+		req = &controlRequest{Alias: params[0], ID: params[1], Options: params[2:]}
+		path, resp = "/alias", new(controlOK)
+		printf = func() {}
+	case "unalias":
+		if len(params) < 1 {
+			fs.Usage()
+			return 2
+		}
+
+		req = &controlRequest{Alias: params[0]}
+		path, resp = "/unalias", new(controlOK)
+		printf = func() {}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown ctl command "+cmd)
+		fs.Usage()
+		return 2
+	}
+
+	raw, err := c.do(path, req, resp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if jsonOutput {
+		os.Stdout.Write(raw)
+	} else {
+		printf()
+	}
+
+	return 0
+}
+
+type ctlClient struct {
+	http *http.Client
+}
+
+// do calls control API and decodes response into resp, raw response is returned as well
+func (c *ctlClient) do(path string, req *controlRequest, resp interface{}) (raw []byte, err error) {
+	var r *http.Response
+	if req == nil {
+		r, err = c.http.Get("http://unix" + path)
+	} else {
+		var b []byte
+		b, err = json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err = c.http.Post("http://unix"+path, "application/json", bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Is forwarder running with -daemon or -control? %s", err)
+	}
+	defer r.Body.Close()
+
+	raw, err = ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.StatusCode != http.StatusOK {
+		var e controlError
+		err = json.Unmarshal(raw, &e)
+		if err != nil || e.Error == "" {
+			return nil, errors.New(r.Status)
+		}
+		return nil, errors.New(e.Error)
+	}
+
+	err = json.Unmarshal(raw, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+func printCtlList(list *controlList) {
+	fmt.Println("Open ports:")
+	for _, port := range list.OpenPorts {
+		fmt.Println("  " + port.Network + ":" + strconv.Itoa(int(port.Port)))
+	}
+
+	fmt.Println("Connections:")
+	for _, conn := range list.Connections {
+		fmt.Println("  " + conn.ID + " on " + conn.ListenIP)
+		for _, port := range conn.Ports {
+			info := "    " + port.Network + ":" + strconv.Itoa(int(port.Port))
+			if port.Name != "" {
+				info += " " + port.Name
+			}
+			if port.LocalAddr != "" {
+				info += " -> " + port.LocalAddr
+			}
+			fmt.Println(info)
+		}
+	}
+}
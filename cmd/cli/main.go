@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"unicode"
 
@@ -39,13 +42,21 @@ func init() {
 	}
 
 	zap.ReplaceGlobals(logger)
+}
 
-	p2pforwarder.OnError(func(err error) {
-		zap.L().Error(err.Error())
-	})
-	p2pforwarder.OnInfo(func(str string) {
-		zap.L().Info(str)
-	})
+func logEvent(e p2pforwarder.Event) {
+	switch e := e.(type) {
+	case p2pforwarder.EventError, p2pforwarder.EventDialFailed:
+		zap.L().Error(e.String())
+	case p2pforwarder.EventConnectionState:
+		if e.State == p2pforwarder.ConnStateConnected {
+			zap.L().Info(e.String())
+		} else {
+			zap.L().Warn(e.String())
+		}
+	default:
+		zap.L().Info(e.String())
+	}
 }
 
 type strArrFlags []string
@@ -60,14 +71,35 @@ func (saf *strArrFlags) Set(value string) error {
 }
 
 var (
-	fwr          *p2pforwarder.Forwarder
-	fwrCancel    func()
-	connections  = make(map[string]func())
+	portOffset     int
+	portOffsetMode bool
+)
+
+var (
+	fwr       *p2pforwarder.Forwarder
+	fwrCancel func()
+
+	// stateMux guards maps below, commands come both from stdin and control API
+	stateMux     sync.Mutex
+	connections  = make(map[string]*connection)
 	openTCPPorts = make(map[uint16]func())
 	openUDPPorts = make(map[uint16]func())
+
+	// Ports and connections restored from previous run, which are not taken over by flags or config yet
+	restoredPorts = make(map[string]struct{}) // NETWORK:PORT
+	restoredPeers = make(map[string]struct{}) // peer id
 )
 
+type connection struct {
+	listenip string
+	cancel   func()
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
 	connectIds := strArrFlags{}
 	flag.Var(&connectIds, "connect", "Add id you want connect to (can be used multiple times).")
 
@@ -77,60 +109,162 @@ func main() {
 	udpPorts := strArrFlags{}
 	flag.Var(&udpPorts, "udp", "Add udp port you want to open (can be used multiple times).")
 
+	swarmKeyPath := flag.String("swarmkey", "", "Path to swarm key file. If set, forwarder talks only to peers with the same key.")
+
+	lanOnly := flag.Bool("lan", false, "Work without internet, discovering peers on the local network only.")
+
+	flag.IntVar(&portOffset, "portoffset", 0, "Listen ports of connected peers on 127.0.0.1 with local port = remote port + offset.")
+
+	daemon := flag.Bool("daemon", false, "Run without reading commands from stdin, forwarder is controlled through control socket.")
+
+	controlPath := flag.String("control", "", "Path to unix socket of control API. Default path is used in daemon mode, if not set.")
+
+	configPath := flag.String("config", "", "Path to YAML config file. It is read again on SIGHUP.")
+
+	profile := flag.String("profile", "", "Name of profile in config file, which is applied on top of it.")
+
+	persist := flag.Bool("persist", false, "Remember open ports and connections and restore them on next start with this flag.")
+
 	flag.Parse()
 
+	flag.Visit(func(fl *flag.Flag) {
+		if fl.Name == "portoffset" {
+			portOffsetMode = true
+		}
+	})
+
 	zap.L().Info("Initialization...")
 
+	if *profile != "" && *configPath == "" {
+		zap.L().Error("-profile requires -config")
+		return
+	}
+
+	var cfg *fileConfig
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath, *profile)
+		if err != nil {
+			zap.S().Error(err)
+			return
+		}
+	}
+
+	opts := []p2pforwarder.Option{
+		p2pforwarder.EventHandler(logEvent),
+	}
+	if cfg != nil {
+		opts = append(opts, cfg.options()...)
+	}
+	if *swarmKeyPath != "" {
+		opts = append(opts, p2pforwarder.PrivateNetworkFromFile(*swarmKeyPath))
+	}
+	if *lanOnly {
+		opts = append(opts, p2pforwarder.LocalNetworkOnly())
+	}
+	if *persist {
+		opts = append(opts, p2pforwarder.PersistState(""))
+	}
+
 	var err error
 
-	fwr, fwrCancel, err = p2pforwarder.NewForwarder()
+	fwr, fwrCancel, err = p2pforwarder.NewForwarder(context.Background(), opts...)
 	if err != nil {
 		zap.S().Error(err)
+		return
 	}
 
 	zap.L().Info("Your id: " + fwr.ID())
 
+	stateMux.Lock()
+	adoptRestored()
+	stateMux.Unlock()
+
+	// Flags don't carry options, so ports and connections restored with their options are kept as they are
 	for _, port := range tcpPorts {
-		cmdOpen([]string{"tcp", port})
+		if !keepRestoredPort("tcp", port) {
+			cmdOpen([]string{"tcp", port})
+		}
 	}
 	for _, port := range udpPorts {
-		cmdOpen([]string{"udp", port})
+		if !keepRestoredPort("udp", port) {
+			cmdOpen([]string{"udp", port})
+		}
 	}
 
 	for _, id := range connectIds {
-		cmdConnect([]string{id})
+		if !keepRestoredPeer(id) {
+			cmdConnect([]string{id, ""})
+		}
+	}
+
+	if cfg != nil {
+		stateMux.Lock()
+		applyConfig(cfg)
+		stateMux.Unlock()
+	}
+
+	if *daemon && *controlPath == "" {
+		*controlPath, err = defaultControlPath()
+		if err != nil {
+			zap.S().Error(err)
+			shutdown()
+			return
+		}
+	}
+	if *controlPath != "" {
+		stopControl, err := startControlServer(*controlPath)
+		if err != nil {
+			zap.S().Error(err)
+			shutdown()
+			return
+		}
+		defer stopControl()
+
+		zap.L().Info("Control API is served on " + *controlPath)
 	}
 
 	zap.L().Info("Initialization completed")
 
 	cmdch := make(chan string)
 
-	go func() {
-		scanner := bufio.NewScanner(os.Stdin)
+	if !*daemon {
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
 
-		for {
-			scanner.Scan()
-			err = scanner.Err()
+			for {
+				scanner.Scan()
+				err = scanner.Err()
 
-			if err != nil {
-				zap.S().Error(err)
-				continue
-			}
+				if err != nil {
+					zap.S().Error(err)
+					continue
+				}
 
-			cmdch <- scanner.Text()
-		}
-	}()
+				cmdch <- scanner.Text()
+			}
+		}()
+	}
 
 	termSignal := make(chan os.Signal, 1)
 	signal.Notify(termSignal, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
 
-	executeCommand("")
+	hupSignal := make(chan os.Signal, 1)
+	if *configPath != "" {
+		signal.Notify(hupSignal, syscall.SIGHUP)
+	}
+
+	if !*daemon {
+		executeCommand("")
+	}
 
 loop:
 	for {
 		select {
 		case str := <-cmdch:
 			executeCommand(str)
+		case <-hupSignal:
+			reloadConfig(*configPath, *profile)
 		case <-termSignal:
 			shutdown()
 			break loop
@@ -141,10 +275,13 @@ loop:
 func shutdown() {
 	zap.L().Info("Shutdown...")
 
+	stateMux.Lock()
+	defer stateMux.Unlock()
+
 	fwrCancel()
 
-	for _, cancel := range connections {
-		cancel()
+	for _, conn := range connections {
+		conn.cancel()
 	}
 	for _, cancel := range openTCPPorts {
 		cancel()
@@ -154,6 +291,105 @@ func shutdown() {
 	}
 }
 
+// adoptRestored makes ports and connections, which forwarder restored from previous run,
+// to be managed by commands. It must be called with stateMux locked.
+func adoptRestored() {
+	for _, port := range fwr.OpenPorts() {
+		network, port := port.Network, port.Port
+
+		closeFn := func() {
+			fwr.ClosePort(network, port)
+		}
+		if network == "udp" {
+			openUDPPorts[port] = closeFn
+		} else {
+			openTCPPorts[port] = closeFn
+		}
+
+		restoredPorts[network+":"+strconv.Itoa(int(port))] = struct{}{}
+
+		zap.L().Info("Restored " + network + ":" + strconv.Itoa(int(port)))
+	}
+
+	for _, conn := range fwr.Connections() {
+		id := conn.PeerID
+
+		connections[id] = &connection{
+			listenip: conn.ListenIP,
+			cancel: func() {
+				fwr.Disconnect(id)
+			},
+		}
+
+		restoredPeers[id] = struct{}{}
+
+		zap.L().Info("Restored connection to " + id + ", its ports are listened on " + conn.ListenIP)
+	}
+}
+
+// restoredPort returns restored port, which is not taken over yet, or nil.
+// It must be called with stateMux locked.
+func restoredPort(networkType string, port uint16) *p2pforwarder.OpenedPort {
+	networkType = strings.ToLower(networkType)
+
+	if _, ok := restoredPorts[networkType+":"+strconv.Itoa(int(port))]; !ok {
+		return nil
+	}
+
+	for _, op := range fwr.OpenPorts() {
+		if op.Network == networkType && op.Port == port {
+			return &op
+		}
+	}
+
+	return nil
+}
+
+// releaseRestoredPort closes restored port, so it can be opened again with other options.
+// It must be called with stateMux locked.
+func releaseRestoredPort(networkType string, portStr string) {
+	networkType = strings.ToLower(networkType)
+
+	key := networkType + ":" + portStr
+	if _, ok := restoredPorts[key]; !ok {
+		return
+	}
+	delete(restoredPorts, key)
+
+	err := closePort(networkType, portStr)
+	if err != nil {
+		zap.S().Error(err)
+	}
+}
+
+// keepRestoredPort reports if port is restored, in this case it is taken over with its restored options.
+// It must be called with stateMux locked.
+func keepRestoredPort(networkType string, portStr string) bool {
+	key := networkType + ":" + portStr
+	if _, ok := restoredPorts[key]; !ok {
+		return false
+	}
+	delete(restoredPorts, key)
+
+	zap.L().Info(key + " is restored from previous run, its options are kept")
+
+	return true
+}
+
+// keepRestoredPeer reports if connection to peer is restored, in this case it is taken over with its restored options.
+// It must be called with stateMux locked.
+func keepRestoredPeer(id string) bool {
+	key := peerKey(id)
+	if _, ok := restoredPeers[key]; !ok {
+		return false
+	}
+	delete(restoredPeers, key)
+
+	zap.L().Info("Connection to " + id + " is restored from previous run, its options are kept")
+
+	return true
+}
+
 func parseArgs(argsStr string, n int) []string {
 	if n <= 0 {
 		return []string{}
@@ -200,6 +436,9 @@ func executeCommand(str string) {
 	cmd := strings.ToLower(args[0])
 	params := args[1:]
 
+	stateMux.Lock()
+	defer stateMux.Unlock()
+
 	switch cmd {
 	case "connect":
 		cmdConnect(params)
@@ -209,67 +448,368 @@ func executeCommand(str string) {
 		cmdOpen(params)
 	case "close":
 		cmdClose(params)
+	case "ports":
+		cmdPorts(params)
+	case "filter":
+		cmdFilter(params)
+	case "alias":
+		cmdAlias(params)
+	case "unalias":
+		cmdUnalias(params)
+	case "aliases":
+		cmdAliases(params)
 	default:
 		zap.L().Info("")
 		zap.L().Info("Cli commands list:")
-		zap.L().Info("connect [ID_HERE]")
+		zap.L().Info("connect [ID_HERE] [OPTIONAL ip=LISTEN_IP offset=PORT_OFFSET map=TCP_OR_UDP:REMOTE_PORT:LOCAL_PORT udpmux=true retry=true services=NAME,NAME ports=TCP_OR_UDP:PORT,TCP_OR_UDP:PORT]")
 		zap.L().Info("disconnect [ID_HERE]")
-		zap.L().Info("open [TCP_OR_UDP_HERE] [PORT_NUMBER_HERE]")
+		zap.L().Info("open [TCP_OR_UDP_HERE] [PORT_NUMBER_HERE] [OPTIONAL target=HOST:PORT allow=ID,ID deny=ID,ID name=NAME desc=DESCRIPTION]")
 		zap.L().Info("close [UDP_OR_UDP_HERE] [PORT_NUMBER_HERE]")
+		zap.L().Info("ports [ID_HERE]")
+		zap.L().Info("filter [ID_HERE] [OPTIONAL services=NAME,NAME ports=TCP_OR_UDP:PORT,TCP_OR_UDP:PORT]")
+		zap.L().Info("alias [ALIAS_HERE] [ID_HERE] [OPTIONAL MULTIADDR MULTIADDR]")
+		zap.L().Info("unalias [ALIAS_HERE]")
+		zap.L().Info("aliases")
+		zap.L().Info("Alias can be used instead of id in every command.")
 		zap.L().Info("")
 	}
 }
 
 func cmdConnect(params []string) {
-	id := params[0]
+	_, err := connect(params[0], strings.Fields(params[1]))
+	if err != nil {
+		zap.S().Error(err)
+	}
+}
+
+// connect connects to id with options parsed by parseConnectOptions, it must be called with stateMux locked
+func connect(id string, args []string) (listenip string, err error) {
+	var opts []p2pforwarder.ConnectOption
+	if portOffsetMode {
+		opts = append(opts, p2pforwarder.PortOffset(portOffset))
+	}
+
+	connectOpts, err := parseConnectOptions(args)
+	if err != nil {
+		return "", err
+	}
+	opts = append(opts, connectOpts...)
 
 	zap.L().Info("Connecting to " + id)
 
-	listenip, cancel, err := fwr.Connect(id)
+	// Restored connection is taken over, it is kept, if its options are the same,
+	// otherwise it is replaced by connection, which is retried like restored one
+	key := peerKey(id)
+	_, restored := restoredPeers[key]
+
+	var cancel context.CancelFunc
+	if restored {
+		listenip, cancel, err = fwr.Reconnect(id, append(opts, p2pforwarder.KeepRetrying())...)
+	} else {
+		listenip, cancel, err = fwr.Connect(id, opts...)
+	}
 	if err != nil {
-		zap.S().Error(err)
-		return
+		return "", err
 	}
 
-	connections[id] = cancel
+	delete(restoredPeers, key)
+	connections[key] = &connection{listenip: listenip, cancel: cancel}
 
 	zap.L().Info("Connections to " + id + "'s ports are listened on " + listenip)
+
+	return listenip, nil
 }
 
-func cmdDisconnect(params []string) {
+// peerKey returns peer id, which is aliased by id, or id itself. Connections are keyed by it.
+func peerKey(id string) string {
+	peerid, err := fwr.ResolvePeer(id)
+	if err != nil {
+		return id
+	}
+
+	return peerid
+}
+
+// resolvePeers returns peer ids, which are aliased by ids, ids, which are not aliases, are returned as is
+func resolvePeers(ids []string) ([]string, error) {
+	resolved := make([]string, 0, len(ids))
+	for _, id := range ids {
+		peerid, err := fwr.ResolvePeer(id)
+		if err != nil {
+			return nil, errors.New("Peer " + id + ": " + err.Error())
+		}
+		resolved = append(resolved, peerid)
+	}
+
+	return resolved, nil
+}
+
+// parseConnectOptions parses "ip=IP", "offset=N", "map=NETWORK:REMOTE_PORT:LOCAL_PORT", "udpmux=BOOL", "retry=BOOL",
+// "services=NAME,NAME" and "ports=NETWORK:PORT,NETWORK:PORT" options.
+// Bare ip is accepted as well.
+func parseConnectOptions(args []string) ([]p2pforwarder.ConnectOption, error) {
+	var opts []p2pforwarder.ConnectOption
+
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 1 {
+			opts = append(opts, p2pforwarder.ListenIP(arg))
+			continue
+		}
+
+		switch strings.ToLower(kv[0]) {
+		case "ip":
+			opts = append(opts, p2pforwarder.ListenIP(kv[1]))
+		case "offset":
+			offset, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, p2pforwarder.PortOffset(offset))
+		case "map":
+			parts := strings.Split(kv[1], ":")
+			if len(parts) != 3 {
+				return nil, errors.New("Port mapping must look like NETWORK:REMOTE_PORT:LOCAL_PORT")
+			}
+			remote, err := strconv.ParseUint(parts[1], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			local, err := strconv.ParseUint(parts[2], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, p2pforwarder.MapPort(strings.ToLower(parts[0]), uint16(remote), uint16(local)))
+		case "udpmux":
+			mux, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			if mux {
+				opts = append(opts, p2pforwarder.MultiplexUDP())
+			}
+		case "retry":
+			retry, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			if retry {
+				opts = append(opts, p2pforwarder.KeepRetrying())
+			}
+		case "services", "ports":
+			var pf p2pforwarder.PortFilter
+			err := parsePortFilterOption(&pf, kv[0], kv[1])
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, p2pforwarder.Filter(pf))
+		default:
+			return nil, errors.New("Unknown connect option " + kv[0])
+		}
+	}
+
+	return opts, nil
+}
+
+// parsePortFilterOption adds "services=NAME,NAME" or "ports=NETWORK:PORT,NETWORK:PORT" option to pf
+func parsePortFilterOption(pf *p2pforwarder.PortFilter, key string, value string) error {
+	switch strings.ToLower(key) {
+	case "services":
+		pf.Services = append(pf.Services, strings.Split(value, ",")...)
+	case "ports":
+		for _, portInfo := range strings.Split(value, ",") {
+			parts := strings.Split(portInfo, ":")
+			if len(parts) != 2 {
+				return errors.New("Port must look like NETWORK:PORT")
+			}
+			port, err := strconv.ParseUint(parts[1], 10, 16)
+			if err != nil {
+				return err
+			}
+
+			switch strings.ToLower(parts[0]) {
+			case "tcp":
+				pf.TCP = append(pf.TCP, uint16(port))
+			case "udp":
+				pf.UDP = append(pf.UDP, uint16(port))
+			default:
+				return p2pforwarder.ErrUnknownNetworkType
+			}
+		}
+	default:
+		return errors.New("Unknown filter option " + key)
+	}
+
+	return nil
+}
+
+// cmdFilter replaces filter of connected peer's ports, without options every port is listened
+func cmdFilter(params []string) {
 	id := params[0]
 
-	close := connections[id]
+	var pf p2pforwarder.PortFilter
+	for _, arg := range strings.Fields(params[1]) {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			zap.L().Error("Filter option must look like KEY=VALUE")
+			return
+		}
 
-	if close == nil {
-		zap.L().Error("You are not connected to specified id")
+		err := parsePortFilterOption(&pf, kv[0], kv[1])
+		if err != nil {
+			zap.S().Error(err)
+			return
+		}
+	}
+
+	err := fwr.SetPortFilter(id, pf)
+	if err != nil {
+		zap.S().Error(err)
+		return
+	}
+
+	if pf.IsEmpty() {
+		zap.L().Info("Every port of " + id + " is listened")
+	} else {
+		zap.L().Info("Filter of " + id + "'s ports is changed")
+	}
+}
+
+func cmdAlias(params []string) {
+	alias := params[0]
+	args := strings.Fields(params[1])
+	if len(args) == 0 {
+		zap.L().Error("Peer id is not specified")
+		return
+	}
+
+	err := fwr.SetAlias(alias, args[0], args[1:]...)
+	if err != nil {
+		zap.S().Error(err)
+		return
+	}
+
+	zap.L().Info(alias + " is saved as alias of " + args[0])
+}
+
+func cmdUnalias(params []string) {
+	err := fwr.RemoveAlias(params[0])
+	if err != nil {
+		zap.S().Error(err)
+		return
+	}
+
+	zap.L().Info(params[0] + " is removed from address book")
+}
+
+func cmdAliases(_ []string) {
+	aliases := fwr.Aliases()
+	if len(aliases) == 0 {
+		zap.L().Info("Address book is empty")
 		return
 	}
 
+	zap.L().Info("Address book:")
+	for _, alias := range aliases {
+		info := alias.Name + " - " + alias.PeerID
+		if len(alias.Addrs) != 0 {
+			info += " " + strings.Join(alias.Addrs, " ")
+		}
+		zap.L().Info(info)
+	}
+}
+
+func cmdDisconnect(params []string) {
+	err := disconnect(params[0])
+	if err != nil {
+		zap.S().Error(err)
+	}
+}
+
+// disconnect must be called with stateMux locked
+func disconnect(id string) error {
+	conn := connections[peerKey(id)]
+
+	if conn == nil {
+		return errors.New("You are not connected to specified id")
+	}
+
 	zap.L().Info("Disconnecting from " + id)
 
-	close()
+	conn.cancel()
 
-	delete(connections, id)
+	delete(connections, peerKey(id))
+
+	return nil
 }
 
-func cmdOpen(params []string) {
-	networkType := strings.ToLower(params[0])
+func cmdPorts(params []string) {
+	id := params[0]
 
-	portStr := params[1]
-	portUint64, err := strconv.ParseUint(portStr, 10, 16)
+	ports, err := fwr.RemotePorts(id)
 	if err != nil {
 		zap.S().Error(err)
 		return
 	}
-	port := uint16(portUint64)
 
-	zap.L().Info("Opening " + networkType + ":" + portStr)
+	zap.L().Info(id + "'s ports:")
+	for _, port := range ports {
+		info := port.Network + ":" + strconv.Itoa(int(port.Port))
+		if port.Name != "" {
+			info += " " + port.Name
+		}
+		if port.Description != "" {
+			info += " (" + port.Description + ")"
+		}
+		if port.LocalAddr != "" {
+			info += " is listened on " + port.LocalAddr
+		} else {
+			info += " is not listened"
+		}
+		zap.L().Info(info)
+	}
+}
+
+func cmdOpen(params []string) {
+	args := strings.Fields(params[1])
+	if len(args) == 0 {
+		zap.L().Error("Port number is not specified")
+		return
+	}
 
-	cancel, err := fwr.OpenPort(networkType, port)
+	err := openPort(params[0], args[0], args[1:])
 	if err != nil {
 		zap.S().Error(err)
-		return
+	}
+}
+
+// openPort opens port with options parsed by parseOpenOptions, it must be called with stateMux locked
+func openPort(networkType string, portStr string, args []string) error {
+	networkType = strings.ToLower(networkType)
+
+	portUint64, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	port := uint16(portUint64)
+
+	opts, err := parseOpenOptions(args)
+	if err != nil {
+		return err
+	}
+
+	return openPortWithOptions(networkType, port, opts...)
+}
+
+// openPortWithOptions must be called with stateMux locked
+func openPortWithOptions(networkType string, port uint16, opts ...p2pforwarder.PortOption) error {
+	networkType = strings.ToLower(networkType)
+
+	zap.L().Info("Opening " + networkType + ":" + strconv.Itoa(int(port)))
+
+	cancel, err := fwr.OpenPort(networkType, port, opts...)
+	if err != nil {
+		return err
 	}
 
 	switch networkType {
@@ -278,34 +818,92 @@ func cmdOpen(params []string) {
 	case "udp":
 		openUDPPorts[port] = cancel
 	}
+
+	return nil
+}
+
+// parseOpenOptions parses "target=HOST:PORT", "allow=ID,ID", "deny=ID,ID", "name=NAME" and "desc=DESCRIPTION" options.
+// Aliases may be used instead of ids. Underscores in description are replaced with spaces.
+func parseOpenOptions(args []string) ([]p2pforwarder.PortOption, error) {
+	var (
+		opts []p2pforwarder.PortOption
+
+		name        string
+		description string
+	)
+
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Open option must look like KEY=VALUE")
+		}
+
+		switch strings.ToLower(kv[0]) {
+		case "target":
+			opts = append(opts, p2pforwarder.Target(kv[1]))
+		case "allow", "deny":
+			ids, err := resolvePeers(strings.Split(kv[1], ","))
+			if err != nil {
+				return nil, err
+			}
+			if strings.ToLower(kv[0]) == "allow" {
+				opts = append(opts, p2pforwarder.AllowPeers(ids...))
+			} else {
+				opts = append(opts, p2pforwarder.DenyPeers(ids...))
+			}
+		case "name":
+			name = kv[1]
+		case "desc":
+			description = strings.ReplaceAll(kv[1], "_", " ")
+		default:
+			return nil, errors.New("Unknown open option " + kv[0])
+		}
+	}
+
+	if name != "" || description != "" {
+		opts = append(opts, p2pforwarder.Service(name, description))
+	}
+
+	return opts, nil
 }
 
 func cmdClose(params []string) {
-	networkType := strings.ToLower(params[0])
-	portStr := params[1]
-	portUint64, err := strconv.ParseUint(portStr, 10, 16)
+	err := closePort(params[0], params[1])
 	if err != nil {
 		zap.S().Error(err)
-		return
+	}
+}
+
+// closePort must be called with stateMux locked
+func closePort(networkType string, portStr string) error {
+	networkType = strings.ToLower(networkType)
+
+	portUint64, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
 	}
 	port := uint16(portUint64)
 
-	var cancel func()
+	var openPorts map[uint16]func()
 	switch networkType {
 	case "tcp":
-		cancel = openTCPPorts[port]
+		openPorts = openTCPPorts
 	case "udp":
-		cancel = openUDPPorts[port]
+		openPorts = openUDPPorts
+	default:
+		return p2pforwarder.ErrUnknownNetworkType
 	}
 
+	cancel := openPorts[port]
 	if cancel == nil {
-		zap.L().Error("Specified port is not opened")
-		return
+		return errors.New("Specified port is not opened")
 	}
 
 	zap.L().Info("Closing " + networkType + ":" + portStr)
 
 	cancel()
 
-	delete(openTCPPorts, port)
+	delete(openPorts, port)
+
+	return nil
 }
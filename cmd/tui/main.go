@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/VladimirMarkelov/clui"
 	p2pforwarder "github.com/nickname32/p2p-forwarder"
 )
 
+var persist = flag.Bool("persist", false, "Remember open ports and connections and restore them on next start with this flag.")
+
 func main() {
+	flag.Parse()
+
 	clui.InitLibrary()
 	defer clui.DeinitLibrary()
 
@@ -30,14 +37,17 @@ func createView() {
 	frame := clui.CreateFrame(win, 0, 0, clui.BorderThin, clui.AutoSize)
 	frame.SetPack(clui.Vertical)
 
-	onErrFn, onInfoFn := createLog(clui.CreateFrame(win, 0, 0, clui.BorderThin, clui.AutoSize))
-	p2pforwarder.OnError(onErrFn)
-	p2pforwarder.OnInfo(onInfoFn)
+	onEventFn, onInfoFn := createLog(clui.CreateFrame(win, 0, 0, clui.BorderThin, clui.AutoSize))
 
 	label := clui.CreateLabel(frame, 64, 1, "Initialization...", clui.AutoSize)
 	clui.RefreshScreen()
 
-	fwr, cancel, err := p2pforwarder.NewForwarder()
+	opts := []p2pforwarder.Option{p2pforwarder.EventHandler(onEventFn)}
+	if *persist {
+		opts = append(opts, p2pforwarder.PersistState(""))
+	}
+
+	fwr, cancel, err := p2pforwarder.NewForwarder(context.Background(), opts...)
 	if err != nil {
 		label.SetTitle("Error: " + err.Error())
 		return
@@ -56,7 +66,7 @@ func createView() {
 	createPortsControl(frame, fwr)
 }
 
-func createLog(parent clui.Control) (onErrFn func(error), onInfoFn func(string)) {
+func createLog(parent clui.Control) (onEventFn func(p2pforwarder.Event), onInfoFn func(string)) {
 	textView := clui.CreateTextView(parent, 0, 0, clui.AutoSize)
 	textView.SetMaxItems(500)
 	textView.SetAutoScroll(true)
@@ -70,8 +80,19 @@ func createLog(parent clui.Control) (onErrFn func(error), onInfoFn func(string))
 		}
 	}()
 
-	return func(err error) {
-			logCh <- "Error - " + err.Error()
+	return func(e p2pforwarder.Event) {
+			switch e := e.(type) {
+			case p2pforwarder.EventError, p2pforwarder.EventDialFailed:
+				logCh <- "Error - " + e.String()
+			case p2pforwarder.EventConnectionState:
+				if e.State == p2pforwarder.ConnStateConnected {
+					logCh <- "Info - " + e.String()
+				} else {
+					logCh <- "Warning - " + e.String()
+				}
+			default:
+				logCh <- "Info - " + e.String()
+			}
 		}, func(str string) {
 			logCh <- "Info - " + str
 		}
@@ -99,7 +120,7 @@ func createConnections(parent clui.Control, fwr *p2pforwarder.Forwarder) {
 	frameB := clui.CreateFrame(frameA, 0, 0, clui.BorderNone, clui.Fixed)
 	frameB.SetPack(clui.Vertical)
 
-	editField := clui.CreateEditField(frameB, 56, "id here", clui.Fixed)
+	editField := clui.CreateEditField(frameB, 56, "id or alias here", clui.Fixed)
 
 	frameC := clui.CreateFrame(frameB, 0, 0, clui.BorderNone, clui.Fixed)
 	frameC.SetPack(clui.Horizontal)
@@ -111,7 +132,96 @@ func createConnections(parent clui.Control, fwr *p2pforwarder.Forwarder) {
 	buttonB := clui.CreateButton(frameD, 9, 4, "Disconn", clui.Fixed)
 	listBox := clui.CreateListBox(frameD, 56, 4, clui.Fixed)
 
+	portsView := clui.CreateTextView(parent, 65, 4, clui.Fixed)
+
+	// Address book, selected alias is put into edit field
+	clui.CreateLabel(parent, 65, 1, "Address book", clui.Fixed)
+	aliasesBox := clui.CreateListBox(parent, 65, 3, clui.Fixed)
+
+	aliases := fwr.Aliases()
+	for _, alias := range aliases {
+		aliasesBox.AddItem(alias.Name + " - " + alias.PeerID)
+	}
+	aliasesBox.OnSelectItem(func(e clui.Event) {
+		if e.Y >= 0 && e.Y < len(aliases) {
+			editField.SetTitle(aliases[e.Y].Name)
+		}
+	})
+
+	// peerTitle shows both alias and id of peer
+	peerTitle := func(id string) string {
+		for _, alias := range aliases {
+			if alias.Name == id {
+				return id + " (" + alias.PeerID + ")"
+			}
+			if alias.PeerID == id {
+				return alias.Name + " (" + id + ")"
+			}
+		}
+		return id
+	}
+
 	connsMap := map[string]func(){}
+	var connsMux sync.Mutex
+
+	refreshCh := make(chan struct{}, 1)
+	go func() {
+		for range refreshCh {
+			connsMux.Lock()
+			ids := make([]string, 0, len(connsMap))
+			for id := range connsMap {
+				ids = append(ids, id)
+			}
+			connsMux.Unlock()
+
+			var lines []string
+			for _, id := range ids {
+				ports, err := fwr.RemotePorts(id)
+				if err != nil {
+					continue
+				}
+
+				lines = append(lines, peerTitle(id)+":")
+				for _, port := range ports {
+					line := "  " + port.Network + ":" + strconv.Itoa(int(port.Port))
+					if port.Name != "" {
+						line += " " + port.Name
+					}
+					if port.LocalAddr != "" {
+						line += " -> " + port.LocalAddr
+					}
+					lines = append(lines, line)
+				}
+			}
+
+			portsView.SetText(lines)
+			clui.RefreshScreen()
+		}
+	}()
+	refreshPorts := func() {
+		select {
+		case refreshCh <- struct{}{}:
+		default:
+		}
+	}
+
+	fwr.OnEvent(func(e p2pforwarder.Event) {
+		switch e.(type) {
+		case p2pforwarder.EventRemotePortsChanged, p2pforwarder.EventListening, p2pforwarder.EventListeningStopped:
+			refreshPorts()
+		}
+	})
+
+	// Connections restored from previous run
+	for _, conn := range fwr.Connections() {
+		id := conn.PeerID
+
+		listBox.AddItem(id)
+		connsMap[id] = func() {
+			fwr.Disconnect(id)
+		}
+	}
+	refreshPorts()
 
 	buttonA.OnClick(func(_ clui.Event) {
 		connInfo := strings.TrimSpace(editField.Title())
@@ -131,9 +241,12 @@ func createConnections(parent clui.Control, fwr *p2pforwarder.Forwarder) {
 			}
 		}
 
+		connsMux.Lock()
 		connsMap[connInfo] = cancel
+		connsMux.Unlock()
 
 		label.SetTitle("Connections are listened on " + listenip)
+		refreshPorts()
 	})
 	buttonB.OnClick(func(_ clui.Event) {
 		itemid := listBox.SelectedItem()
@@ -153,9 +266,12 @@ func createConnections(parent clui.Control, fwr *p2pforwarder.Forwarder) {
 			return
 		}
 
+		connsMux.Lock()
 		connsMap[connInfo]()
-
 		delete(connsMap, connInfo)
+		connsMux.Unlock()
+
+		refreshPorts()
 	})
 }
 
@@ -175,7 +291,7 @@ func createPortsControl(parent clui.Control, fwr *p2pforwarder.Forwarder) {
 
 	editFieldA := clui.CreateEditField(frameC, 13, "tcp/udp here", clui.Fixed)
 	clui.CreateLabel(frameC, 1, 1, " ", clui.Fixed)
-	editFieldB := clui.CreateEditField(frameC, 16, "port here", clui.Fixed)
+	editFieldB := clui.CreateEditField(frameC, 24, "port [host:port] [name]", clui.Fixed)
 
 	label := clui.CreateLabel(frameB, 56, 1, "", clui.Fixed)
 
@@ -186,8 +302,29 @@ func createPortsControl(parent clui.Control, fwr *p2pforwarder.Forwarder) {
 
 	portsMap := map[string]func(){}
 
+	// Ports restored from previous run
+	for _, op := range fwr.OpenPorts() {
+		network, port := op.Network, op.Port
+
+		portInfo := network + ":" + strconv.Itoa(int(port))
+		if op.Name != "" {
+			portInfo += " " + op.Name
+		}
+
+		listBox.AddItem(portInfo)
+		portsMap[portInfo] = func() {
+			fwr.ClosePort(network, port)
+		}
+	}
+
 	buttonA.OnClick(func(_ clui.Event) {
-		portstr := strings.TrimSpace(editFieldB.Title())
+		// Port may be followed by target host:port and service name
+		portFields := strings.Fields(editFieldB.Title())
+		if len(portFields) == 0 {
+			label.SetTitle("Error: port is not specified")
+			return
+		}
+		portstr := portFields[0]
 		networkType := strings.ToLower(strings.TrimSpace(editFieldA.Title()))
 
 		port, err := strconv.ParseUint(portstr, 10, 16)
@@ -196,13 +333,29 @@ func createPortsControl(parent clui.Control, fwr *p2pforwarder.Forwarder) {
 			return
 		}
 
-		cancel, err := fwr.OpenPort(networkType, uint16(port))
+		var (
+			opts []p2pforwarder.PortOption
+			name string
+		)
+		for _, field := range portFields[1:] {
+			if strings.Contains(field, ":") {
+				opts = append(opts, p2pforwarder.Target(field))
+			} else {
+				name = field
+				opts = append(opts, p2pforwarder.Service(name, ""))
+			}
+		}
+
+		cancel, err := fwr.OpenPort(networkType, uint16(port), opts...)
 		if err != nil {
 			label.SetTitle("Error: " + err.Error())
 			return
 		}
 
 		portInfo := networkType + ":" + portstr
+		if name != "" {
+			portInfo += " " + name
+		}
 
 		ok := listBox.AddItem(portInfo)
 		if !ok {
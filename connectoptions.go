@@ -0,0 +1,221 @@
+package p2pforwarder
+
+import (
+	"net"
+)
+
+// ConnectOption - option for Forwarder.Connect
+type ConnectOption func(cc *connectConfig) error
+
+type connectConfig struct {
+	listenIP net.IP
+
+	offsetMode bool
+	portOffset int
+
+	portsMap map[forwardedPortKey]uint16
+
+	multiplexUDP bool
+
+	filter PortFilter
+
+	keepRetrying bool
+}
+
+// newConnectConfig applies opts to empty config
+func newConnectConfig(opts []ConnectOption) (*connectConfig, error) {
+	cc := &connectConfig{}
+	for _, opt := range opts {
+		err := opt(cc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cc, nil
+}
+
+// KeepRetrying makes Connect return as soon as connection is registered, without waiting for peer.
+// Peer is subscribed to in background and resubscribed to until connection is cancelled,
+// so connection is kept, even if peer is not reachable at the moment.
+// Progress is reported by EventConnectionState.
+func KeepRetrying() ConnectOption {
+	return func(cc *connectConfig) error {
+		cc.keepRetrying = true
+		return nil
+	}
+}
+
+// ListenIP pins ip, on which peer's ports are listened, instead of allocating one
+func ListenIP(ip string) ConnectOption {
+	return func(cc *connectConfig) error {
+		cc.listenIP = net.ParseIP(ip)
+		if cc.listenIP == nil {
+			return ErrInvalidListenIP
+		}
+
+		return nil
+	}
+}
+
+// PortOffset listens peer's ports on local port = remote port + offset.
+// Unless ListenIP is passed, ports are listened on 127.0.0.1, which is useful on platforms,
+// where only 127.0.0.1 of the loopback range is available.
+// Use Forwarder.ForwardedPorts to find out actual local addresses.
+func PortOffset(offset int) ConnectOption {
+	return func(cc *connectConfig) error {
+		cc.offsetMode = true
+		cc.portOffset = offset
+		return nil
+	}
+}
+
+// MapPort listens peer's remote port on specified local port.
+// It takes priority over PortOffset. If local port is busy, other one is chosen,
+// use Forwarder.ForwardedPorts to find out actual local addresses.
+func MapPort(networkType string, remote uint16, local uint16) ConnectOption {
+	return func(cc *connectConfig) error {
+		protocolType, err := protocolTypeFromNetwork(networkType)
+		if err != nil {
+			return err
+		}
+
+		if cc.portsMap == nil {
+			cc.portsMap = make(map[forwardedPortKey]uint16)
+		}
+		cc.portsMap[forwardedPortKey{protocolType: protocolType, port: remote}] = local
+
+		return nil
+	}
+}
+
+// localPort returns local port, on which remote port should be listened
+func (cc *connectConfig) localPort(protocolType byte, port uint16) int {
+	if lport, ok := cc.portsMap[forwardedPortKey{protocolType: protocolType, port: port}]; ok {
+		return int(lport)
+	}
+
+	if cc.offsetMode {
+		return int(port) + cc.portOffset
+	}
+
+	return int(port)
+}
+
+// MultiplexUDP makes all UDP flows of every peer's port to be carried in one stream
+// instead of stream per local UDP client. It is useful for UDP services with many clients.
+func MultiplexUDP() ConnectOption {
+	return func(cc *connectConfig) error {
+		cc.multiplexUDP = true
+		return nil
+	}
+}
+
+// PortFilter - selects peer's ports, which are listened locally.
+// Port is selected, if it is listed in TCP or UDP, or its service name is listed in Services.
+// Empty filter selects every port.
+type PortFilter struct {
+	TCP      []uint16
+	UDP      []uint16
+	Services []string
+}
+
+// IsEmpty reports if filter selects every port
+func (pf PortFilter) IsEmpty() bool {
+	return len(pf.TCP) == 0 && len(pf.UDP) == 0 && len(pf.Services) == 0
+}
+
+// copy returns filter, which does not share slices with pf
+func (pf PortFilter) copy() PortFilter {
+	return PortFilter{
+		TCP:      append([]uint16(nil), pf.TCP...),
+		UDP:      append([]uint16(nil), pf.UDP...),
+		Services: append([]string(nil), pf.Services...),
+	}
+}
+
+// selects reports if port with specified service name passes filter
+func (pf PortFilter) selects(protocolType byte, port uint16, service string) bool {
+	if pf.IsEmpty() {
+		return true
+	}
+
+	ports := pf.TCP
+	if protocolType == protocolTypeUDP {
+		ports = pf.UDP
+	}
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+
+	if service == "" {
+		return false
+	}
+	for _, name := range pf.Services {
+		if name == service {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectPorts returns ports of manifest, which pass filter
+func (pf PortFilter) selectPorts(portsM *portsManifest, protocolType byte) []uint16 {
+	ports := portsM.tcp
+	if protocolType == protocolTypeUDP {
+		ports = portsM.udp
+	}
+
+	if pf.IsEmpty() {
+		return ports
+	}
+
+	selected := make([]uint16, 0, len(ports))
+	for _, port := range ports {
+		if pf.selects(protocolType, port, portsM.service(protocolType, port).name) {
+			selected = append(selected, port)
+		}
+	}
+
+	return selected
+}
+
+// Filter makes only ports, which pass filter, to be listened.
+// Other peer's ports are still reported by Forwarder.RemotePorts.
+// Filter may be changed later with Forwarder.SetPortFilter.
+func Filter(pf PortFilter) ConnectOption {
+	return func(cc *connectConfig) error {
+		cc.filter.TCP = append(cc.filter.TCP, pf.TCP...)
+		cc.filter.UDP = append(cc.filter.UDP, pf.UDP...)
+		cc.filter.Services = append(cc.filter.Services, pf.Services...)
+		return nil
+	}
+}
+
+// OnlyPorts makes only specified ports in networkType - "tcp" or "udp" to be listened, see Filter
+func OnlyPorts(networkType string, ports ...uint16) ConnectOption {
+	return func(cc *connectConfig) error {
+		protocolType, err := protocolTypeFromNetwork(networkType)
+		if err != nil {
+			return err
+		}
+
+		if protocolType == protocolTypeTCP {
+			cc.filter.TCP = append(cc.filter.TCP, ports...)
+		} else {
+			cc.filter.UDP = append(cc.filter.UDP, ports...)
+		}
+		return nil
+	}
+}
+
+// Services makes only ports with specified service names to be listened, see Service and Filter
+func Services(names ...string) ConnectOption {
+	return func(cc *connectConfig) error {
+		cc.filter.Services = append(cc.filter.Services, names...)
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package p2pforwarder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery"
+)
+
+const (
+	mdnsServiceTag = "_p2pforwarder-discovery._udp"
+	mdnsInterval   = 10 * time.Second
+)
+
+type mdnsNotifee struct {
+	ctx context.Context
+	f   *Forwarder
+}
+
+// HandlePeerFound connects to peers found on the local network, so they become dialable by id
+func (n *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == n.f.host.ID() {
+		return
+	}
+
+	err := n.f.host.Connect(n.ctx, pi)
+	if err != nil {
+		n.f.onErr(fmt.Errorf("local discovery: %s", err))
+		return
+	}
+
+	n.f.onInfo("Found " + pi.ID.Pretty() + " on the local network")
+}
+
+// startLocalDiscovery starts mDNS service, which works until ctx is done
+func (f *Forwarder) startLocalDiscovery(ctx context.Context) error {
+	service, err := discovery.NewMdnsService(ctx, f.host, mdnsInterval, mdnsServiceTag)
+	if err != nil {
+		return err
+	}
+
+	service.RegisterNotifee(&mdnsNotifee{
+		ctx: ctx,
+		f:   f,
+	})
+
+	go func() {
+		<-ctx.Done()
+		service.Close()
+	}()
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package p2pforwarder
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Event - something, that happened inside Forwarder.
+// Concrete event types are listed below, use type switch to handle them.
+type Event interface {
+	String() string
+}
+
+// EventInfo - informational message
+type EventInfo struct {
+	Message string
+}
+
+func (e EventInfo) String() string {
+	return e.Message
+}
+
+// EventError - error, which is not bound to any specific port or connection
+type EventError struct {
+	Err error
+}
+
+func (e EventError) String() string {
+	return e.Err.Error()
+}
+
+// EventPortOpened - port was opened with OpenPort
+type EventPortOpened struct {
+	Network string
+	Port    uint16
+}
+
+func (e EventPortOpened) String() string {
+	return "Opened " + e.Network + ":" + strconv.Itoa(int(e.Port))
+}
+
+// EventPortClosed - port opened with OpenPort was closed
+type EventPortClosed struct {
+	Network string
+	Port    uint16
+}
+
+func (e EventPortClosed) String() string {
+	return "Closed " + e.Network + ":" + strconv.Itoa(int(e.Port))
+}
+
+// EventPeerSubscribed - peer subscribed to manifest of our open ports
+type EventPeerSubscribed struct {
+	PeerID string
+}
+
+func (e EventPeerSubscribed) String() string {
+	return e.PeerID + " subscribed to open ports"
+}
+
+// EventStreamAccepted - peer started forwarding connection to our open port.
+// Target is empty, if port is forwarded to localhost.
+type EventStreamAccepted struct {
+	PeerID  string
+	Network string
+	Port    uint16
+	Target  string
+}
+
+func (e EventStreamAccepted) String() string {
+	str := "Dialing to " + e.Network + ":" + strconv.Itoa(int(e.Port))
+	if e.Target != "" {
+		str += " (" + e.Target + ")"
+	}
+	return str + " from " + e.PeerID
+}
+
+// EventStreamClosed - forwarded connection from peer to our open port was closed
+type EventStreamClosed struct {
+	PeerID  string
+	Network string
+	Port    uint16
+}
+
+func (e EventStreamClosed) String() string {
+	return "Closed dial to " + e.Network + ":" + strconv.Itoa(int(e.Port)) + " from " + e.PeerID
+}
+
+// EventListening - started listening for connections to peer's port.
+// Fallback is true, if requested local port was busy and other one was chosen.
+type EventListening struct {
+	PeerID   string
+	Network  string
+	Port     uint16
+	Addr     string
+	Fallback bool
+}
+
+func (e EventListening) String() string {
+	str := "Listening " + e.Network + " " + e.Addr + " -> " + strconv.Itoa(int(e.Port))
+	if e.Fallback {
+		str += " (requested local port is busy)"
+	}
+	return str
+}
+
+// EventListeningStopped - stopped listening for connections to peer's port
+type EventListeningStopped struct {
+	PeerID  string
+	Network string
+	Port    uint16
+	Addr    string
+}
+
+func (e EventListeningStopped) String() string {
+	return "Closed " + e.Network + " " + e.Addr + " -> " + strconv.Itoa(int(e.Port))
+}
+
+// EventConnAccepted - local connection to peer's port was accepted
+type EventConnAccepted struct {
+	PeerID     string
+	Network    string
+	Port       uint16
+	LocalAddr  string
+	RemoteAddr string
+}
+
+func (e EventConnAccepted) String() string {
+	return "Accepted " + e.Network + " connection from " + e.RemoteAddr + " on " + e.LocalAddr
+}
+
+// EventConnClosed - local connection to peer's port was closed
+type EventConnClosed struct {
+	PeerID     string
+	Network    string
+	Port       uint16
+	LocalAddr  string
+	RemoteAddr string
+}
+
+func (e EventConnClosed) String() string {
+	return "Closed " + e.Network + " connection from " + e.RemoteAddr + " on " + e.LocalAddr
+}
+
+// EventRemotePortsChanged - connected peer changed set of ports it offers
+type EventRemotePortsChanged struct {
+	PeerID string
+	Ports  []RemotePort
+}
+
+func (e EventRemotePortsChanged) String() string {
+	str := e.PeerID + " offers ports:"
+	for _, port := range e.Ports {
+		str += " " + port.Network + ":" + strconv.Itoa(int(port.Port))
+		if port.Name != "" {
+			str += "(" + port.Name + ")"
+		}
+	}
+	return str
+}
+
+// Reasons of closing UDP sessions
+const (
+	ReapReasonIdle = "idle timeout"
+)
+
+// EventUDPSessionReaped - UDP session was closed by Forwarder.
+// Port is either our open port or connected peer's port. Addr is address of local UDP client,
+// it is empty for sessions of our open ports.
+type EventUDPSessionReaped struct {
+	PeerID string
+	Port   uint16
+	Addr   string
+	Reason string
+}
+
+func (e EventUDPSessionReaped) String() string {
+	str := "Closed udp session of " + e.PeerID + " udp:" + strconv.Itoa(int(e.Port))
+	if e.Addr != "" {
+		str += " from " + e.Addr
+	}
+	return str + ": " + e.Reason
+}
+
+// EventUDPSessionRefused - new UDP session was not started, because session limit is reached.
+// Port is either our open port or connected peer's port. Addr is address of local UDP client,
+// it is empty for sessions of our open ports. Local client is reported once, until its session is started.
+type EventUDPSessionRefused struct {
+	PeerID string
+	Port   uint16
+	Addr   string
+}
+
+func (e EventUDPSessionRefused) String() string {
+	str := "Refused udp session of " + e.PeerID + " udp:" + strconv.Itoa(int(e.Port))
+	if e.Addr != "" {
+		str += " from " + e.Addr
+	}
+	return str + ": session limit reached"
+}
+
+// EventDialFailed - forwarding connection to peer's port failed
+type EventDialFailed struct {
+	PeerID  string
+	Network string
+	Port    uint16
+	Err     error
+}
+
+func (e EventDialFailed) String() string {
+	return "Dial to " + e.PeerID + " " + e.Network + ":" + strconv.Itoa(int(e.Port)) + " failed: " + e.Err.Error()
+}
+
+// States of connections to peers, which are created by Connect
+const (
+	ConnStateConnected    = "connected"
+	ConnStateReconnecting = "reconnecting"
+	ConnStateLost         = "lost"
+)
+
+// EventConnectionState - state of subscription to peer's ports changed.
+// Forwarder keeps reconnecting to peer in ConnStateLost state too, until connection is cancelled.
+// Err is nil for ConnStateConnected.
+type EventConnectionState struct {
+	PeerID string
+	State  string
+	Err    error
+}
+
+func (e EventConnectionState) String() string {
+	str := "Connection to " + e.PeerID + " is " + e.State
+	if e.Err != nil {
+		str += ": " + e.Err.Error()
+	}
+	return str
+}
+
+type eventHandlers struct {
+	handlers []eventHandler
+	nextID   int
+	mux      sync.Mutex
+}
+
+type eventHandler struct {
+	id int
+	fn func(Event)
+}
+
+// OnEvent registers function, which is called on every event of this Forwarder.
+// Handlers are called synchronously, so they must not block for long.
+func (f *Forwarder) OnEvent(fn func(Event)) (remove func()) {
+	f.events.mux.Lock()
+	id := f.events.nextID
+	f.events.nextID++
+	f.events.handlers = append(f.events.handlers, eventHandler{id: id, fn: fn})
+	f.events.mux.Unlock()
+
+	return func() {
+		f.events.mux.Lock()
+		for i, h := range f.events.handlers {
+			if h.id == id {
+				f.events.handlers = append(f.events.handlers[:i:i], f.events.handlers[i+1:]...)
+				break
+			}
+		}
+		f.events.mux.Unlock()
+	}
+}
+
+func (f *Forwarder) emit(e Event) {
+	f.events.mux.Lock()
+	fns := make([]func(Event), 0, len(f.events.handlers))
+	for _, h := range f.events.handlers {
+		fns = append(fns, h.fn)
+	}
+	f.events.mux.Unlock()
+
+	if len(fns) == 0 {
+		println(e.String())
+		return
+	}
+
+	for _, fn := range fns {
+		fn(e)
+	}
+}
+
+func (f *Forwarder) onErr(err error) {
+	f.emit(EventError{Err: err})
+}
+
+func (f *Forwarder) onInfo(str string) {
+	f.emit(EventInfo{Message: str})
+}
@@ -2,11 +2,11 @@ package p2pforwarder
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
-	"time"
 
 	"github.com/libp2p/go-libp2p"
 	relay "github.com/libp2p/go-libp2p-circuit"
@@ -28,18 +28,52 @@ import (
 const (
 	protocolTypeTCP byte = 0x00
 	protocolTypeUDP byte = 0x01
+	// protocolTypeUDPMux carries all UDP flows of port in one stream
+	protocolTypeUDPMux byte = 0x02
 )
 
+func protocolTypeFromNetwork(networkType string) (byte, error) {
+	switch networkType {
+	case "tcp":
+		return protocolTypeTCP, nil
+	case "udp":
+		return protocolTypeUDP, nil
+	}
+
+	return 0, ErrUnknownNetworkType
+}
+
+func networkName(protocolType byte) string {
+	switch protocolType {
+	case protocolTypeTCP:
+		return "tcp"
+	case protocolTypeUDP, protocolTypeUDPMux:
+		return "udp"
+	}
+
+	return "unknown"
+}
+
 // Forwarder - instance of P2P Forwarder
 type Forwarder struct {
 	host      host.Host
 	openPorts *openPortsStore
 
-	portsSubscriptions    map[peer.ID]chan *portsManifest
+	portsSubscriptions    map[peer.ID]*connection
 	portsSubscriptionsMux sync.Mutex
 
-	portsSubscribers    map[peer.ID]struct{}
+	portsSubscribers    map[peer.ID]*subscriber
 	portsSubscribersMux sync.Mutex
+
+	events eventHandlers
+
+	ipAllocator ListenIPAllocator
+
+	udpLimits udpLimits
+
+	state *stateStore // nil, if state is not persisted
+
+	addressBook *addressBook
 }
 
 type openPortsStore struct {
@@ -48,31 +82,128 @@ type openPortsStore struct {
 }
 
 type openPortsStoreMap struct {
-	ports map[uint16]context.Context
+	ports map[uint16]*openPort
 	mux   sync.Mutex
 }
 
+type openPort struct {
+	ctx    context.Context
+	cancel func()
+
+	target string // host:port, which is dialed instead of localhost
+
+	service     string // name, which is advertised to peers
+	description string
+
+	udpLimits   *udpLimits // nil if Forwarder's defaults are used
+	udpSessions int32
+
+	allowedPeers map[peer.ID]struct{}
+	deniedPeers  map[peer.ID]struct{}
+}
+
+// isAllowed reports if peerid may see and dial this port
+func (op *openPort) isAllowed(peerid peer.ID) bool {
+	if _, ok := op.deniedPeers[peerid]; ok {
+		return false
+	}
+
+	if len(op.allowedPeers) == 0 {
+		return true
+	}
+
+	_, ok := op.allowedPeers[peerid]
+	return ok
+}
+
+// connection - our subscription to peer's ports, created by Connect
+type connection struct {
+	ctx        context.Context // done, when connection is cancelled
+	cancel     context.CancelFunc
+	unregister func() // cancels connection, but keeps it in saved state
+	subCh      chan *portsManifest
+
+	cc       *connectConfig
+	listenip string
+
+	filter    PortFilter
+	filterMux sync.Mutex
+	filterCh  chan struct{} // notifies about filter change
+
+	forwarded    map[forwardedPortKey]ForwardedPort
+	forwardedMux sync.Mutex
+
+	manifest    *portsManifest // last received one
+	manifestMux sync.Mutex
+}
+
+type forwardedPortKey struct {
+	protocolType byte
+	port         uint16
+}
+
 func newOpenPortsStore() *openPortsStore {
 	return &openPortsStore{
 		tcp: &openPortsStoreMap{
-			ports: map[uint16]context.Context{},
+			ports: map[uint16]*openPort{},
 		},
 		udp: &openPortsStoreMap{
-			ports: map[uint16]context.Context{},
+			ports: map[uint16]*openPort{},
 		},
 	}
 }
 
 // NewForwarder - instances Forwarder and connects it to libp2p network
-func NewForwarder() (*Forwarder, context.CancelFunc, error) {
-	priv, err := loadUserPrivKey()
+func NewForwarder(ctx context.Context, opts ...Option) (*Forwarder, context.CancelFunc, error) {
+	cfg := defaultConfig()
+
+	for _, opt := range opts {
+		err := opt(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if cfg.priv == nil {
+		krPath, err := configPath("keypair")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cfg.priv, err = loadPrivKey(krPath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if cfg.ipAllocator == nil {
+		ipsPath, err := configPath("listenips")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cfg.ipAllocator, err = defaultListenIPAllocator(ipsPath)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !cfg.addressBookCustom {
+		var err error
+		cfg.addressBookPath, err = configPath("addressbook")
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	ab, err := loadAddressBook(cfg.addressBookPath)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 
-	h, err := createLibp2pHost(ctx, priv)
+	h, err := createLibp2pHost(ctx, cfg)
 	if err != nil {
 		cancel()
 		return nil, nil, err
@@ -83,25 +214,58 @@ func NewForwarder() (*Forwarder, context.CancelFunc, error) {
 
 		openPorts: newOpenPortsStore(),
 
-		portsSubscriptions: make(map[peer.ID]chan *portsManifest),
-		portsSubscribers:   make(map[peer.ID]struct{}),
+		portsSubscriptions: make(map[peer.ID]*connection),
+		portsSubscribers:   make(map[peer.ID]*subscriber),
+
+		ipAllocator: cfg.ipAllocator,
+
+		udpLimits: cfg.udpLimits,
+
+		addressBook: ab,
 	}
 
+	for _, fn := range cfg.eventHandlers {
+		f.OnEvent(fn)
+	}
+
+	f.addKnownAddrs()
+
 	setDialHandler(f)
 	setPortsSubHandler(f)
 
+	if cfg.mdns {
+		err = f.startLocalDiscovery(ctx)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+	}
+
+	if cfg.statePath != "" {
+		f.state, err = loadStateStore(ctx, cfg.statePath, func(err error) {
+			f.emit(EventError{Err: fmt.Errorf("saving state: %s", err)})
+		})
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+
+		f.restoreState()
+	}
+
 	return f, cancel, nil
 }
 
-func loadUserPrivKey() (priv crypto.PrivKey, err error) {
-	krPath, err := appdir.AppInfo{
+// configPath returns path to file with specified name inside user's config directory
+func configPath(name string) (string, error) {
+	return appdir.AppInfo{
 		Author: "nickname32",
 		Name:   "P2P Forwarder",
-	}.ConfigPath("keypair")
-	if err != nil {
-		return nil, err
-	}
+	}.ConfigPath(name)
+}
 
+// loadPrivKey loads private key from krPath or generates new one and saves it there
+func loadPrivKey(krPath string) (priv crypto.PrivKey, err error) {
 	pkFile, err := os.Open(krPath)
 
 	if err == nil {
@@ -153,26 +317,68 @@ func loadUserPrivKey() (priv crypto.PrivKey, err error) {
 	return priv, nil
 }
 
-func createLibp2pHost(ctx context.Context, priv crypto.PrivKey) (host.Host, error) {
+func createLibp2pHost(ctx context.Context, cfg *config) (host.Host, error) {
 	var d *dht.IpfsDHT
 
-	h, err := libp2p.NewWithoutDefaults(ctx,
-		libp2p.Identity(priv),
+	if cfg.psk != nil {
+		// QUIC does not support private networks
+		delete(cfg.transports, TransportQUIC)
 
-		libp2p.ListenAddrStrings(
-			"/ip4/0.0.0.0/udp/0/quic",
-			"/ip6/::/udp/0/quic",
+		if len(cfg.transports) == 0 {
+			return nil, ErrNoTransports
+		}
+	}
 
-			"/ip4/0.0.0.0/tcp/0",
-			"/ip6/::/tcp/0",
+	listenAddrs := cfg.listenAddrs
+	if listenAddrs == nil {
+		listenAddrs = cfg.defaultListenAddrs()
+	}
 
-			"/ip4/0.0.0.0/tcp/0/ws",
-			"/ip6/::/tcp/0/ws",
-		),
+	var transports []libp2p.Option
+	if cfg.transports[TransportQUIC] {
+		transports = append(transports, libp2p.Transport(libp2pquic.NewTransport))
+	}
+	if cfg.transports[TransportTCP] {
+		transports = append(transports, libp2p.Transport(tcp.NewTCPTransport))
+	}
+	if cfg.transports[TransportWebsocket] {
+		transports = append(transports, libp2p.Transport(websocket.New))
+	}
 
-		libp2p.Transport(libp2pquic.NewTransport),
-		libp2p.Transport(tcp.NewTCPTransport),
-		libp2p.Transport(websocket.New),
+	relayOpts := []libp2p.Option{
+		libp2p.EnableAutoRelay(),
+		libp2p.EnableRelay(relay.OptActive),
+		libp2p.DefaultStaticRelays(),
+	}
+	if cfg.relaysCustom {
+		if len(cfg.relays) == 0 {
+			relayOpts = []libp2p.Option{libp2p.DisableRelay()}
+		} else {
+			relayOpts = []libp2p.Option{
+				libp2p.EnableAutoRelay(),
+				libp2p.EnableRelay(relay.OptActive),
+				libp2p.StaticRelays(cfg.relays),
+			}
+		}
+	}
+
+	var routingOpt libp2p.Option = libp2p.ChainOptions()
+	if cfg.dht {
+		routingOpt = libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
+			var err error
+			d, err = dht.New(ctx, h, dht.BootstrapPeers(cfg.bootstrapPeers...))
+			return d, err
+		})
+	}
+
+	h, err := libp2p.NewWithoutDefaults(ctx,
+		libp2p.Identity(cfg.priv),
+
+		libp2p.ListenAddrStrings(listenAddrs...),
+
+		libp2p.ChainOptions(transports...),
+
+		libp2p.PrivateNetwork(cfg.psk),
 
 		libp2p.Security(noise.ID, noise.New),
 		libp2p.Security(libp2ptls.ID, libp2ptls.New),
@@ -180,43 +386,35 @@ func createLibp2pHost(ctx context.Context, priv crypto.PrivKey) (host.Host, erro
 		libp2p.Muxer("/yamux/1.0.0", yamux.DefaultTransport),
 
 		libp2p.ConnectionManager(connmgr.NewConnManager(
-			100,         // Lowwater
-			400,         // HighWater,
-			time.Minute, // GracePeriod
+			cfg.connMgrLow,   // Lowwater
+			cfg.connMgrHigh,  // HighWater,
+			cfg.connMgrGrace, // GracePeriod
 		)),
 
 		libp2p.NATPortMap(),
 
 		libp2p.EnableNATService(),
 
-		libp2p.EnableAutoRelay(),
-		libp2p.EnableRelay(relay.OptActive),
-		libp2p.DefaultStaticRelays(),
+		libp2p.ChainOptions(relayOpts...),
 
 		libp2p.DefaultPeerstore,
 
-		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
-			var err error
-			d, err = dht.New(ctx, h, dht.BootstrapPeers(dht.GetDefaultBootstrapPeerAddrInfos()...))
-			return d, err
-		}),
+		routingOpt,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	// This connects to public bootstrappers
-	for _, addr := range dht.DefaultBootstrapPeers {
-		pi, err := peer.AddrInfoFromP2pAddr(addr)
-		if err != nil {
-			panic(err)
-		}
-		h.Connect(ctx, *pi)
+	// This connects to bootstrappers
+	for _, pi := range cfg.bootstrapPeers {
+		h.Connect(ctx, pi)
 	}
 
-	err = d.Bootstrap(ctx)
-	if err != nil {
-		return nil, err
+	if d != nil {
+		err = d.Bootstrap(ctx)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return h, err
@@ -226,26 +424,3 @@ func createLibp2pHost(ctx context.Context, priv crypto.PrivKey) (host.Host, erro
 func (f *Forwarder) ID() string {
 	return f.host.ID().Pretty()
 }
-
-var onErrFn = func(err error) {
-	println(err.Error())
-}
-var onInfoFn = func(str string) {
-	println(str)
-}
-
-// OnError sets function which be called on error inside this package
-func OnError(fn func(error)) {
-	if fn == nil {
-		return
-	}
-	onErrFn = fn
-}
-
-// OnInfo sets function which be called on information inside this package
-func OnInfo(fn func(string)) {
-	if fn == nil {
-		return
-	}
-	onInfoFn = fn
-}
@@ -18,8 +18,11 @@ require (
 	github.com/libp2p/go-libp2p-yamux v0.5.3
 	github.com/libp2p/go-tcp-transport v0.2.2
 	github.com/libp2p/go-ws-transport v0.4.0
+	github.com/multiformats/go-multiaddr v0.3.1
 	github.com/nsf/termbox-go v0.0.0-20201124104050-ed494de23a00 // indirect
 	github.com/pion/udp v0.1.1-0.20201216163422-c79b416a74b3
 	github.com/sparkymat/appdir v0.0.0-20190803090504-1c2ab64aee87
 	go.uber.org/zap v1.16.0
+	google.golang.org/protobuf v1.25.0
+	gopkg.in/yaml.v2 v2.3.0
 )
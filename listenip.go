@@ -0,0 +1,201 @@
+package p2pforwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrInvalidListenIP = error "Invalid listen ip"
+var ErrInvalidListenIP = errors.New("Invalid listen ip")
+
+// ListenIPAllocator - allocates local ips, on which ports of connected peers are listened
+type ListenIPAllocator interface {
+	// Allocate returns ip for peer with specified id
+	Allocate(id string) (net.IP, error)
+	// Release is called, when connection to peer with specified id is closed
+	Release(id string)
+}
+
+// DefaultListenIPRange - range of ips, which are allocated by default
+const DefaultListenIPRange = "127.0.89.0/24"
+
+// Default allocators are shared by all Forwarders of the process, which use the same file,
+// so connections of different Forwarders never get the same ip
+var (
+	defaultIPAllocators    = make(map[string]ListenIPAllocator) // path -> allocator
+	defaultIPAllocatorsMux sync.Mutex
+)
+
+// defaultListenIPAllocator returns allocator over DefaultListenIPRange saved at path, creating it once per process
+func defaultListenIPAllocator(path string) (ListenIPAllocator, error) {
+	defaultIPAllocatorsMux.Lock()
+	defer defaultIPAllocatorsMux.Unlock()
+
+	if a, ok := defaultIPAllocators[path]; ok {
+		return a, nil
+	}
+
+	a, err := NewListenIPAllocator(DefaultListenIPRange, path)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultIPAllocators[path] = a
+
+	return a, nil
+}
+
+type rangeIPAllocator struct {
+	ipnet *net.IPNet
+
+	path     string
+	reserved map[string]string // peer id -> ip
+	inUse    map[string]string // ip -> peer id
+
+	mux sync.Mutex
+}
+
+// NewListenIPAllocator creates allocator, which hands out ips from cidr range, e.g. "127.0.89.0/24".
+// Allocator is not used by connections with PortOffset and without ListenIP, so to listen on IPv6 loopback
+// connect with ListenIP("::1") together with PortOffset or MapPort instead.
+// If path is not empty, ip of every peer is saved there, so peer gets the same ip after restart.
+func NewListenIPAllocator(cidr string, path string) (ListenIPAllocator, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &rangeIPAllocator{
+		ipnet: ipnet,
+
+		path:     path,
+		reserved: make(map[string]string),
+		inUse:    make(map[string]string),
+	}
+
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(b, &a.reserved)
+			if err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func (a *rangeIPAllocator) Allocate(id string) (net.IP, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	// Peer's ip from previous runs
+	if ipStr, ok := a.reserved[id]; ok {
+		ip := net.ParseIP(ipStr)
+		if ip != nil && a.ipnet.Contains(ip) {
+			if _, ok := a.inUse[ip.String()]; !ok {
+				return a.take(id, ip, false)
+			}
+		}
+	}
+
+	reservedBy := make(map[string]string, len(a.reserved))
+	for peerID, ipStr := range a.reserved {
+		reservedBy[ipStr] = peerID
+	}
+
+	// Free ip, which is not remembered for any other peer
+	for ip := a.ipnet.IP.Mask(a.ipnet.Mask); a.ipnet.Contains(ip); ip = nextIP(ip) {
+		ipStr := ip.String()
+		if _, ok := a.inUse[ipStr]; ok {
+			continue
+		}
+		if _, ok := reservedBy[ipStr]; ok {
+			continue
+		}
+
+		return a.take(id, ip, true)
+	}
+
+	// Free ip, which was remembered for other peer
+	for ip := a.ipnet.IP.Mask(a.ipnet.Mask); a.ipnet.Contains(ip); ip = nextIP(ip) {
+		if _, ok := a.inUse[ip.String()]; ok {
+			continue
+		}
+
+		delete(a.reserved, reservedBy[ip.String()])
+
+		return a.take(id, ip, true)
+	}
+
+	return nil, ErrMaxConnections
+}
+
+// take must be called with a.mux locked
+func (a *rangeIPAllocator) take(id string, ip net.IP, isNew bool) (net.IP, error) {
+	a.inUse[ip.String()] = id
+
+	if isNew {
+		a.reserved[id] = ip.String()
+
+		err := a.save()
+		if err != nil {
+			delete(a.inUse, ip.String())
+			return nil, err
+		}
+	}
+
+	return ip, nil
+}
+
+// save must be called with a.mux locked
+func (a *rangeIPAllocator) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(a.reserved)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(a.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(a.path, b, 0644)
+}
+
+func (a *rangeIPAllocator) Release(id string) {
+	a.mux.Lock()
+	for ipStr, peerID := range a.inUse {
+		if peerID == id {
+			delete(a.inUse, ipStr)
+		}
+	}
+	a.mux.Unlock()
+}
+
+// nextIP returns ip, which follows passed one
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+
+	return next
+}
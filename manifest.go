@@ -0,0 +1,303 @@
+package p2pforwarder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Version of manifest, which is sent on portssubProtID and portssubProtIDv2
+const portsManifestVersion = 1
+
+// maxPortsManifestSize limits size of received manifest
+const maxPortsManifestSize = 1 << 20
+
+var (
+	// ErrManifestTooLarge = error "Ports manifest is too large"
+	ErrManifestTooLarge = errors.New("Ports manifest is too large")
+	// ErrInvalidManifest = error "Invalid ports manifest"
+	ErrInvalidManifest = errors.New("Invalid ports manifest")
+)
+
+type portsManifest struct {
+	tcp []uint16
+	udp []uint16
+
+	services map[forwardedPortKey]portService // only named ports are present
+}
+
+type portService struct {
+	name        string
+	description string
+}
+
+// service returns name of port, it is empty for unnamed ports
+func (m *portsManifest) service(protocolType byte, port uint16) portService {
+	return m.services[forwardedPortKey{protocolType: protocolType, port: port}]
+}
+
+// Field numbers of manifest sent on portssubProtID and portssubProtIDv2.
+//
+//	message PortsManifest {
+//		uint32 version = 1;
+//		repeated Port ports = 2;
+//	}
+//
+//	message Port {
+//		uint32 protocol_type = 1;
+//		uint32 port = 2;
+//		string name = 3;
+//		string description = 4;
+//	}
+//
+// Unknown fields are skipped, so new ones may be added without changing protocol id.
+const (
+	manifestFieldVersion protowire.Number = 1
+	manifestFieldPort    protowire.Number = 2
+
+	manifestPortFieldProtocolType protowire.Number = 1
+	manifestPortFieldPort         protowire.Number = 2
+	manifestPortFieldName         protowire.Number = 3
+	manifestPortFieldDescription  protowire.Number = 4
+)
+
+// marshal encodes manifest in format of portssubProtID and portssubProtIDv2, prefixed with its length
+func (m *portsManifest) marshal() []byte {
+	var b []byte
+
+	b = protowire.AppendTag(b, manifestFieldVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, portsManifestVersion)
+
+	appendPorts := func(protocolType byte, ports []uint16) {
+		for _, port := range ports {
+			var p []byte
+
+			p = protowire.AppendTag(p, manifestPortFieldProtocolType, protowire.VarintType)
+			p = protowire.AppendVarint(p, uint64(protocolType))
+			p = protowire.AppendTag(p, manifestPortFieldPort, protowire.VarintType)
+			p = protowire.AppendVarint(p, uint64(port))
+
+			svc := m.service(protocolType, port)
+			if svc.name != "" {
+				p = protowire.AppendTag(p, manifestPortFieldName, protowire.BytesType)
+				p = protowire.AppendString(p, svc.name)
+			}
+			if svc.description != "" {
+				p = protowire.AppendTag(p, manifestPortFieldDescription, protowire.BytesType)
+				p = protowire.AppendString(p, svc.description)
+			}
+
+			b = protowire.AppendTag(b, manifestFieldPort, protowire.BytesType)
+			b = protowire.AppendBytes(b, p)
+		}
+	}
+
+	appendPorts(protocolTypeTCP, m.tcp)
+	appendPorts(protocolTypeUDP, m.udp)
+
+	return protowire.AppendBytes(nil, b)
+}
+
+// marshalV1 encodes manifest in format of portssubProtIDv1
+func (m *portsManifest) marshalV1() []byte {
+	lt := len(m.tcp)
+	lu := len(m.udp)
+
+	b := make([]byte, 2+lt*2+2+lu*2)
+
+	var i int
+
+	binary.BigEndian.PutUint16(b[i:i+2], uint16(lt))
+	i += 2
+
+	for _, port := range m.tcp {
+		binary.BigEndian.PutUint16(b[i:i+2], port)
+		i += 2
+	}
+
+	binary.BigEndian.PutUint16(b[i:i+2], uint16(lu))
+	i += 2
+
+	for _, port := range m.udp {
+		binary.BigEndian.PutUint16(b[i:i+2], port)
+		i += 2
+	}
+
+	return b
+}
+
+// readPortsManifest reads manifest written by portsManifest.marshal
+func readPortsManifest(r io.Reader) (*portsManifest, error) {
+	size, err := binary.ReadUvarint(byteReader{r})
+	if err != nil {
+		return nil, fmt.Errorf("readPortsManifest: %s", err)
+	}
+
+	if size > maxPortsManifestSize {
+		return nil, ErrManifestTooLarge
+	}
+
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, fmt.Errorf("readPortsManifest: %s", err)
+	}
+
+	return unmarshalPortsManifest(b)
+}
+
+// byteReader reads from underlying reader byte by byte, so nothing after read value is consumed
+type byteReader struct {
+	r io.Reader
+}
+
+func (br byteReader) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(br.r, b)
+	return b[0], err
+}
+
+func unmarshalPortsManifest(b []byte) (*portsManifest, error) {
+	portsM := &portsManifest{
+		tcp: []uint16{},
+		udp: []uint16{},
+
+		services: make(map[forwardedPortKey]portService),
+	}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, ErrInvalidManifest
+		}
+		b = b[n:]
+
+		switch {
+		case num == manifestFieldPort && typ == protowire.BytesType:
+			p, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, ErrInvalidManifest
+			}
+			b = b[n:]
+
+			protocolType, port, svc, err := unmarshalManifestPort(p)
+			if err != nil {
+				return nil, err
+			}
+
+			if svc.name != "" || svc.description != "" {
+				portsM.services[forwardedPortKey{protocolType: protocolType, port: port}] = svc
+			}
+
+			switch protocolType {
+			case protocolTypeTCP:
+				portsM.tcp = append(portsM.tcp, port)
+			case protocolTypeUDP:
+				portsM.udp = append(portsM.udp, port)
+			}
+		default:
+			// Version is informational for now, other fields are unknown
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, ErrInvalidManifest
+			}
+			b = b[n:]
+		}
+	}
+
+	return portsM, nil
+}
+
+func unmarshalManifestPort(b []byte) (protocolType byte, port uint16, svc portService, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, 0, portService{}, ErrInvalidManifest
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.VarintType && (num == manifestPortFieldProtocolType || num == manifestPortFieldPort):
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, 0, portService{}, ErrInvalidManifest
+			}
+			b = b[n:]
+
+			if num == manifestPortFieldProtocolType {
+				if v > 0xff {
+					return 0, 0, portService{}, ErrInvalidManifest
+				}
+				protocolType = byte(v)
+			} else {
+				if v > 0xffff {
+					return 0, 0, portService{}, ErrInvalidManifest
+				}
+				port = uint16(v)
+			}
+		case typ == protowire.BytesType && (num == manifestPortFieldName || num == manifestPortFieldDescription):
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return 0, 0, portService{}, ErrInvalidManifest
+			}
+			b = b[n:]
+
+			if num == manifestPortFieldName {
+				svc.name = v
+			} else {
+				svc.description = v
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return 0, 0, portService{}, ErrInvalidManifest
+			}
+			b = b[n:]
+		}
+	}
+
+	return protocolType, port, svc, nil
+}
+
+// readPortsManifestV1 reads manifest written by portsManifest.marshalV1
+func readPortsManifestV1(r io.Reader) (portsM *portsManifest, err error) {
+	portsM = new(portsManifest)
+
+	portsM.tcp, err = readPortsInManifest(r)
+	if err != nil {
+		return
+	}
+	portsM.udp, err = readPortsInManifest(r)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func readPortsInManifest(r io.Reader) (ports []uint16, err error) {
+	portsNumBytes := make([]byte, 2)
+	_, err = io.ReadFull(r, portsNumBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	portsNum := int(binary.BigEndian.Uint16(portsNumBytes))
+
+	ports = make([]uint16, portsNum)
+
+	for i := 0; i < portsNum; i++ {
+		portBytes := make([]byte, 2)
+		_, err = io.ReadFull(r, portBytes)
+		if err != nil {
+			return nil, fmt.Errorf("readPortsManifest: %s", err)
+		}
+
+		ports[i] = binary.BigEndian.Uint16(portBytes)
+	}
+
+	return ports, nil
+}
@@ -0,0 +1,175 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testManifest() *portsManifest {
+	return &portsManifest{
+		tcp: []uint16{22, 8080},
+		udp: []uint16{25565},
+
+		services: map[forwardedPortKey]portService{
+			{protocolType: protocolTypeTCP, port: 22}:    {name: "ssh"},
+			{protocolType: protocolTypeUDP, port: 25565}: {name: "minecraft", description: "Survival server"},
+		},
+	}
+}
+
+func TestPortsManifestRoundTrip(t *testing.T) {
+	tests := []*portsManifest{
+		testManifest(),
+		{
+			tcp:      []uint16{},
+			udp:      []uint16{},
+			services: map[forwardedPortKey]portService{},
+		},
+	}
+
+	for _, want := range tests {
+		got, err := readPortsManifest(bytes.NewReader(want.marshal()))
+		if err != nil {
+			t.Fatalf("readPortsManifest: %s", err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("readPortsManifest = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestReadPortsManifestConsumesOnlyOneManifest(t *testing.T) {
+	first := testManifest()
+	second := &portsManifest{
+		tcp:      []uint16{443},
+		udp:      []uint16{},
+		services: map[forwardedPortKey]portService{},
+	}
+
+	r := bytes.NewReader(append(first.marshal(), second.marshal()...))
+
+	for _, want := range []*portsManifest{first, second} {
+		got, err := readPortsManifest(r)
+		if err != nil {
+			t.Fatalf("readPortsManifest: %s", err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("readPortsManifest = %+v, want %+v", got, want)
+		}
+	}
+
+	if r.Len() != 0 {
+		t.Errorf("%d bytes are left unread", r.Len())
+	}
+}
+
+func TestUnmarshalPortsManifestSkipsUnknownFields(t *testing.T) {
+	var p []byte
+	p = protowire.AppendTag(p, manifestPortFieldProtocolType, protowire.VarintType)
+	p = protowire.AppendVarint(p, uint64(protocolTypeTCP))
+	p = protowire.AppendTag(p, 100, protowire.BytesType)
+	p = protowire.AppendString(p, "unknown")
+	p = protowire.AppendTag(p, manifestPortFieldPort, protowire.VarintType)
+	p = protowire.AppendVarint(p, 22)
+	p = protowire.AppendTag(p, 101, protowire.Fixed64Type)
+	p = protowire.AppendFixed64(p, 42)
+	p = protowire.AppendTag(p, manifestPortFieldName, protowire.BytesType)
+	p = protowire.AppendString(p, "ssh")
+
+	var b []byte
+	b = protowire.AppendTag(b, manifestFieldVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, portsManifestVersion+1)
+	b = protowire.AppendTag(b, 100, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	b = protowire.AppendTag(b, manifestFieldPort, protowire.BytesType)
+	b = protowire.AppendBytes(b, p)
+	b = protowire.AppendTag(b, 101, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 42)
+
+	got, err := unmarshalPortsManifest(b)
+	if err != nil {
+		t.Fatalf("unmarshalPortsManifest: %s", err)
+	}
+
+	want := &portsManifest{
+		tcp: []uint16{22},
+		udp: []uint16{},
+
+		services: map[forwardedPortKey]portService{
+			{protocolType: protocolTypeTCP, port: 22}: {name: "ssh"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unmarshalPortsManifest = %+v, want %+v", got, want)
+	}
+}
+
+func TestUnmarshalPortsManifestRejectsInvalidPort(t *testing.T) {
+	var p []byte
+	p = protowire.AppendTag(p, manifestPortFieldPort, protowire.VarintType)
+	p = protowire.AppendVarint(p, 0x10000)
+
+	var b []byte
+	b = protowire.AppendTag(b, manifestFieldPort, protowire.BytesType)
+	b = protowire.AppendBytes(b, p)
+
+	_, err := unmarshalPortsManifest(b)
+	if err != ErrInvalidManifest {
+		t.Errorf("unmarshalPortsManifest error = %v, want %v", err, ErrInvalidManifest)
+	}
+}
+
+func TestReadPortsManifestTooLarge(t *testing.T) {
+	b := make([]byte, binary.MaxVarintLen64)
+	b = b[:binary.PutUvarint(b, maxPortsManifestSize+1)]
+
+	_, err := readPortsManifest(bytes.NewReader(b))
+	if err != ErrManifestTooLarge {
+		t.Errorf("readPortsManifest error = %v, want %v", err, ErrManifestTooLarge)
+	}
+}
+
+func TestReadPortsManifestTruncated(t *testing.T) {
+	b := testManifest().marshal()
+
+	for _, n := range []int{0, 1, len(b) / 2, len(b) - 1} {
+		_, err := readPortsManifest(bytes.NewReader(b[:n]))
+		if err == nil {
+			t.Errorf("readPortsManifest of %d of %d bytes succeeded", n, len(b))
+		}
+	}
+
+	// Manifest itself is cut inside of its last field
+	_, n := binary.Uvarint(b)
+	body := b[n:]
+	for _, cut := range []int{1, 2} {
+		_, err := unmarshalPortsManifest(body[:len(body)-cut])
+		if err != ErrInvalidManifest {
+			t.Errorf("unmarshalPortsManifest of %d of %d bytes error = %v, want %v", len(body)-cut, len(body), err, ErrInvalidManifest)
+		}
+	}
+}
+
+func TestPortsManifestV1RoundTrip(t *testing.T) {
+	m := testManifest()
+
+	got, err := readPortsManifestV1(bytes.NewReader(m.marshalV1()))
+	if err != nil {
+		t.Fatalf("readPortsManifestV1: %s", err)
+	}
+
+	if !reflect.DeepEqual(got.tcp, m.tcp) || !reflect.DeepEqual(got.udp, m.udp) {
+		t.Errorf("readPortsManifestV1 = %v %v, want %v %v", got.tcp, got.udp, m.tcp, m.udp)
+	}
+
+	_, err = readPortsManifestV1(bytes.NewReader(m.marshalV1()[:3]))
+	if err == nil {
+		t.Error("readPortsManifestV1 of truncated manifest succeeded")
+	}
+}
@@ -3,7 +3,9 @@ package p2pforwarder
 import (
 	"context"
 	"errors"
-	"strconv"
+	"net"
+	"reflect"
+	"sort"
 	"sync"
 
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -18,28 +20,48 @@ var (
 	ErrUnknownNetworkType = errors.New("Unknown network type, it must be \"tcp\" or \"udp\"")
 	// ErrConnectionExists = error "You are already connected to specified host"
 	ErrConnectionExists = errors.New("You are already connected to specified host")
+	// ErrNotConnected = error "You are not connected to specified host"
+	ErrNotConnected = errors.New("You are not connected to specified host")
+	// ErrPortNotOpened = error "Port is not opened"
+	ErrPortNotOpened = errors.New("Port is not opened")
 )
 
 // OpenPort opens port in specified networkType - "tcp" or "udp"
-func (f *Forwarder) OpenPort(networkType string, port uint16) (cancel func(), err error) {
+func (f *Forwarder) OpenPort(networkType string, port uint16, opts ...PortOption) (cancel func(), err error) {
+	op := &openPort{
+		allowedPeers: make(map[peer.ID]struct{}),
+		deniedPeers:  make(map[peer.ID]struct{}),
+	}
+
+	for _, opt := range opts {
+		err = opt(op)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	switch networkType {
 	case "tcp":
-		cancel, err = f.addOpenPort(f.openPorts.tcp, port)
+		cancel, err = f.addOpenPort(f.openPorts.tcp, networkType, port, op)
 	case "udp":
-		cancel, err = f.addOpenPort(f.openPorts.udp, port)
+		cancel, err = f.addOpenPort(f.openPorts.udp, networkType, port, op)
 	default:
 		cancel, err = nil, ErrUnknownNetworkType
 		return
 	}
 
 	if err == nil {
+		f.state.setPort(newSavedPort(networkType, port, op))
+
+		f.emit(EventPortOpened{Network: networkType, Port: port})
+
 		go f.publishOpenPortsManifest()
 	}
 
 	return cancel, err
 }
 
-func (f *Forwarder) addOpenPort(portsMap *openPortsStoreMap, port uint16) (cancel func(), err error) {
+func (f *Forwarder) addOpenPort(portsMap *openPortsStoreMap, networkType string, port uint16, op *openPort) (cancel func(), err error) {
 	portsMap.mux.Lock()
 
 	if portsMap.ports[port] != nil {
@@ -48,142 +70,632 @@ func (f *Forwarder) addOpenPort(portsMap *openPortsStoreMap, port uint16) (cance
 	}
 
 	var cancelfn func()
-	portsMap.ports[port], cancelfn = context.WithCancel(context.Background())
-
-	portsMap.mux.Unlock()
+	op.ctx, cancelfn = context.WithCancel(context.Background())
+	portsMap.ports[port] = op
 
 	cancel = func() {
 		portsMap.mux.Lock()
 		cancelfn()
+		if portsMap.ports[port] != op {
+			// Already closed
+			portsMap.mux.Unlock()
+			return
+		}
 		delete(portsMap.ports, port)
 		portsMap.mux.Unlock()
 
+		f.state.removePort(networkType, port)
+
+		f.emit(EventPortClosed{Network: networkType, Port: port})
+
 		go f.publishOpenPortsManifest()
 	}
+	op.cancel = cancel
+
+	portsMap.mux.Unlock()
 
 	return cancel, nil
 }
 
-var (
-	listenIPks    = make([]bool, 255)
-	listenIPksMux sync.Mutex
-)
+// ClosePort closes port opened with OpenPort, the same as calling cancel returned by it
+func (f *Forwarder) ClosePort(networkType string, port uint16) error {
+	var portsMap *openPortsStoreMap
+	switch networkType {
+	case "tcp":
+		portsMap = f.openPorts.tcp
+	case "udp":
+		portsMap = f.openPorts.udp
+	default:
+		return ErrUnknownNetworkType
+	}
 
-// Connect starts forwarding connections to `listenip`:`PORT` to passed id`:`PORT`
-func (f *Forwarder) Connect(id string) (listenip string, cancel context.CancelFunc, err error) {
-	peerid, err := peer.IDB58Decode(id)
-	if err != nil {
-		return "", nil, err
+	portsMap.mux.Lock()
+	op := portsMap.ports[port]
+	portsMap.mux.Unlock()
+
+	if op == nil {
+		return ErrPortNotOpened
 	}
 
-	// Getting free ip part
-	listenIPksMux.Lock()
-	lIPk := -1
-	for k, v := range listenIPks {
-		if v {
-			continue
+	op.cancel()
+
+	return nil
+}
+
+// OpenedPort - port, which is opened with OpenPort.
+// AllowedPeers and DeniedPeers are sorted ids passed with AllowPeers and DenyPeers.
+type OpenedPort struct {
+	Network      string
+	Port         uint16
+	Name         string
+	Description  string
+	Target       string
+	AllowedPeers []string
+	DeniedPeers  []string
+}
+
+// OpenPorts returns ports, which are opened at the moment, including restored ones, see PersistState
+func (f *Forwarder) OpenPorts() []OpenedPort {
+	var ports []OpenedPort
+
+	for _, portsMap := range []*openPortsStoreMap{f.openPorts.tcp, f.openPorts.udp} {
+		networkType := "tcp"
+		if portsMap == f.openPorts.udp {
+			networkType = "udp"
+		}
+
+		portsMap.mux.Lock()
+		for port, op := range portsMap.ports {
+			ports = append(ports, OpenedPort{
+				Network:      networkType,
+				Port:         port,
+				Name:         op.service,
+				Description:  op.description,
+				Target:       op.target,
+				AllowedPeers: sortedPeerIDs(op.allowedPeers),
+				DeniedPeers:  sortedPeerIDs(op.deniedPeers),
+			})
+		}
+		portsMap.mux.Unlock()
+	}
+
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Network != ports[j].Network {
+			return ports[i].Network < ports[j].Network
 		}
+		return ports[i].Port < ports[j].Port
+	})
 
-		lIPk = k
-		listenIPks[lIPk] = true
+	return ports
+}
 
-		break
+// Connect starts forwarding connections to `listenip`:`PORT` to passed id`:`PORT`.
+// Alias from address book may be passed instead of id, see SetAlias.
+func (f *Forwarder) Connect(id string, opts ...ConnectOption) (listenip string, cancel context.CancelFunc, err error) {
+	peerid, err := f.resolvePeerID(id)
+	if err != nil {
+		return "", nil, err
 	}
-	if lIPk == -1 {
-		return "", nil, ErrMaxConnections
+
+	cc, err := newConnectConfig(opts)
+	if err != nil {
+		return "", nil, err
 	}
-	listenip = "127.0.89." + strconv.Itoa(lIPk)
-	listenIPksMux.Unlock()
 
+	return f.connect(peerid, cc)
+}
+
+// connect registers connection and subscribes to peer's ports, see KeepRetrying
+func (f *Forwarder) connect(peerid peer.ID, cc *connectConfig) (listenip string, cancel context.CancelFunc, err error) {
 	// Registering subscription
 	f.portsSubscriptionsMux.Lock()
 	if _, ok := f.portsSubscriptions[peerid]; ok {
 		f.portsSubscriptionsMux.Unlock()
+		return "", nil, ErrConnectionExists
+	}
+	sub := &connection{
+		subCh: make(chan *portsManifest, 5),
 
-		listenIPksMux.Lock()
-		listenIPks[lIPk] = false
-		listenIPksMux.Unlock()
+		cc: cc,
 
-		return "", nil, ErrConnectionExists
+		filter:   cc.filter,
+		filterCh: make(chan struct{}, 1),
+
+		forwarded: make(map[forwardedPortKey]ForwardedPort),
 	}
-	subCh := make(chan *portsManifest, 5)
-	f.portsSubscriptions[peerid] = subCh
+	f.portsSubscriptions[peerid] = sub
 	f.portsSubscriptionsMux.Unlock()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// Getting listen ip
+	lip := cc.listenIP
+	if lip == nil && cc.offsetMode {
+		lip = net.IPv4(127, 0, 0, 1)
+	}
+	if lip == nil {
+		lip, err = f.ipAllocator.Allocate(peerid.Pretty())
+		if err != nil {
+			f.portsSubscriptionsMux.Lock()
+			delete(f.portsSubscriptions, peerid)
+			f.portsSubscriptionsMux.Unlock()
+
+			return "", nil, err
+		}
+	}
+	listenip = lip.String()
+	sub.listenip = listenip
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	sub.ctx = ctx
+
+	// Connection is unregistered synchronously, so peer may be connected again right after cancel
+	var unregisterOnce sync.Once
+	unregister := func() {
+		unregisterOnce.Do(func() {
+			cancelCtx()
+
+			f.portsSubscriptionsMux.Lock()
+			if f.portsSubscriptions[peerid] == sub {
+				delete(f.portsSubscriptions, peerid)
+			}
+			f.portsSubscriptionsMux.Unlock()
+
+			if cc.listenIP == nil && !cc.offsetMode {
+				f.ipAllocator.Release(peerid.Pretty())
+			}
+		})
+	}
+
+	cancel = func() {
+		unregister()
+		f.state.removeConnection(peerid.Pretty())
+	}
+
+	f.portsSubscriptionsMux.Lock()
+	sub.cancel = cancel
+	sub.unregister = unregister
+	f.portsSubscriptionsMux.Unlock()
 
 	go func() {
 		var (
 			tcpPortsOld = make(map[uint16]func())
 			udpPortsOld = make(map[uint16]func())
+
+			lastM *portsManifest
 		)
 
+		updatePorts := func(portsM *portsManifest) {
+			sub.filterMux.Lock()
+			filter := sub.filter
+			sub.filterMux.Unlock()
+
+			if portsM.tcp != nil {
+				f.updatePortsListening(ctx, protocolTypeTCP, filter.selectPorts(portsM, protocolTypeTCP), &tcpPortsOld, peerid, sub)
+			}
+
+			if portsM.udp != nil {
+				f.updatePortsListening(ctx, protocolTypeUDP, filter.selectPorts(portsM, protocolTypeUDP), &udpPortsOld, peerid, sub)
+			}
+		}
+
 	loop:
 		for {
 			select {
 			case <-ctx.Done():
-				f.portsSubscriptionsMux.Lock()
-				delete(f.portsSubscriptions, peerid)
-				close(subCh)
-				f.portsSubscriptionsMux.Unlock()
-
-				listenIPksMux.Lock()
-				listenIPks[lIPk] = false
-				listenIPksMux.Unlock()
-
+				// Connection is already unregistered by cancel
 				break loop
-			case portsM := <-subCh:
-				if portsM.tcp != nil {
-					f.updatePortsListening(ctx, protocolTypeTCP, portsM.tcp, &tcpPortsOld, peerid, listenip)
+			case <-sub.filterCh:
+				// Peer's ports are the same, changes are reported by EventListening and EventListeningStopped
+				if lastM != nil {
+					updatePorts(lastM)
 				}
+			case portsM := <-sub.subCh:
+				lastM = portsM
+
+				updatePorts(portsM)
 
-				if portsM.udp != nil {
-					f.updatePortsListening(ctx, protocolTypeUDP, portsM.udp, &udpPortsOld, peerid, listenip)
+				if sub.setManifest(portsM) {
+					f.emit(EventRemotePortsChanged{
+						PeerID: peerid.Pretty(),
+						Ports:  sub.remotePorts(),
+					})
 				}
 			}
 		}
 	}()
 
-	s, err := f.host.NewStream(ctx, peerid, portssubProtID)
-	if err != nil {
-		cancel()
-		return "", nil, err
+	if cc.keepRetrying {
+		f.state.setConnection(newSavedConnection(peerid.Pretty(), cc))
+
+		go func() {
+			s, err := f.subscribe(ctx, peerid)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				f.emit(EventConnectionState{PeerID: peerid.Pretty(), State: ConnStateReconnecting, Err: err})
+
+				s = f.resubscribe(ctx, peerid)
+				if s == nil {
+					return
+				}
+			}
+
+			f.emit(EventConnectionState{PeerID: peerid.Pretty(), State: ConnStateConnected})
+
+			f.keepSubscription(ctx, peerid, sub, s)
+		}()
+
+		return listenip, cancel, nil
 	}
 
 	// This starts subscription
-	_, err = s.Write([]byte{portssubModeSubscribe})
+	s, err := f.subscribe(ctx, peerid)
 	if err != nil {
-		s.Reset()
-		cancel()
+		unregister()
 		return "", nil, err
 	}
 
-	s.Close()
+	f.state.setConnection(newSavedConnection(peerid.Pretty(), cc))
+
+	f.emit(EventConnectionState{PeerID: peerid.Pretty(), State: ConnStateConnected})
+
+	go f.keepSubscription(ctx, peerid, sub, s)
 
 	return listenip, cancel, nil
 }
 
-func (f *Forwarder) updatePortsListening(parentCtx context.Context, protocolType byte, portsArr []uint16, portsOld *map[uint16]func(), peerid peer.ID, listenip string) {
+// Reconnect connects to peer like Connect, but replaces existing connection to it instead of failing.
+// If existing connection has the same options, it is kept and returned as is, KeepRetrying is not compared.
+// Remembered connection, see PersistState, is replaced only by the new one, so it is not lost, if Reconnect fails.
+func (f *Forwarder) Reconnect(id string, opts ...ConnectOption) (listenip string, cancel context.CancelFunc, err error) {
+	peerid, err := f.resolvePeerID(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cc, err := newConnectConfig(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var unregister func()
+
+	f.portsSubscriptionsMux.Lock()
+	sub := f.portsSubscriptions[peerid]
+	if sub != nil {
+		listenip, cancel, unregister = sub.listenip, sub.cancel, sub.unregister
+	}
+	f.portsSubscriptionsMux.Unlock()
+
+	if unregister != nil {
+		if reflect.DeepEqual(sub.savedConnection(peerid), newSavedConnection(peerid.Pretty(), cc)) {
+			return listenip, cancel, nil
+		}
+
+		unregister()
+	}
+
+	return f.connect(peerid, cc)
+}
+
+// savedConnection returns options of connection including its current filter, see SetPortFilter
+func (sub *connection) savedConnection(peerid peer.ID) savedConnection {
+	sub.filterMux.Lock()
+	cc := *sub.cc
+	cc.filter = sub.filter
+	sub.filterMux.Unlock()
+
+	return newSavedConnection(peerid.Pretty(), &cc)
+}
+
+// Disconnect cancels connection created by Connect, the same as calling cancel returned by it
+func (f *Forwarder) Disconnect(id string) error {
+	peerid, err := f.resolvePeerID(id)
+	if err != nil {
+		return err
+	}
+
+	var cancel context.CancelFunc
+
+	f.portsSubscriptionsMux.Lock()
+	if sub := f.portsSubscriptions[peerid]; sub != nil {
+		cancel = sub.cancel
+	}
+	f.portsSubscriptionsMux.Unlock()
+
+	if cancel == nil {
+		return ErrNotConnected
+	}
+
+	cancel()
+
+	return nil
+}
+
+// PeerConnection - connection to peer, which is created with Connect
+type PeerConnection struct {
+	PeerID   string
+	ListenIP string
+}
+
+// Connections returns current connections to peers, including restored ones, see PersistState
+func (f *Forwarder) Connections() []PeerConnection {
+	f.portsSubscriptionsMux.Lock()
+	conns := make([]PeerConnection, 0, len(f.portsSubscriptions))
+	for peerid, sub := range f.portsSubscriptions {
+		// Connection is still being set up
+		if sub.cancel == nil {
+			continue
+		}
+
+		conns = append(conns, PeerConnection{PeerID: peerid.Pretty(), ListenIP: sub.listenip})
+	}
+	f.portsSubscriptionsMux.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].PeerID < conns[j].PeerID
+	})
+
+	return conns
+}
+
+func (f *Forwarder) updatePortsListening(parentCtx context.Context, protocolType byte, portsArr []uint16, portsOld *map[uint16]func(), peerid peer.ID, sub *connection) {
 	ports := make(map[uint16]func())
 
 	for _, port := range portsArr {
-		cancel, ok := (*portsOld)[port]
-
-		if ok {
-			ports[port] = cancel
+		if stop, ok := (*portsOld)[port]; ok {
+			ports[port] = stop
 			delete(*portsOld, port)
+		}
+	}
+
+	// Old listeners are stopped before new ones are started, so their local ports are free again
+	for _, stop := range *portsOld {
+		stop()
+	}
+
+	for _, port := range portsArr {
+		if _, ok := ports[port]; ok {
 			continue
 		}
 
-		var ctx context.Context
-		ctx, ports[port] = context.WithCancel(parentCtx)
+		ports[port] = f.dial(parentCtx, peerid, protocolType, sub, port)
+	}
+
+	*portsOld = ports
+}
+
+// SetPortFilter changes, which ports of connected peer are listened locally.
+// Ports, which don't pass new filter, stop being listened, other connections to peer are kept.
+// Changes are reported by EventListening and EventListeningStopped.
+func (f *Forwarder) SetPortFilter(id string, pf PortFilter) error {
+	peerid, err := f.resolvePeerID(id)
+	if err != nil {
+		return err
+	}
+
+	f.portsSubscriptionsMux.Lock()
+	sub := f.portsSubscriptions[peerid]
+	f.portsSubscriptionsMux.Unlock()
 
-		go f.dial(ctx, peerid, protocolType, listenip, port)
+	if sub == nil {
+		return ErrNotConnected
 	}
 
-	for _, v := range *portsOld {
-		v()
+	sub.filterMux.Lock()
+	sub.filter = pf.copy()
+	sub.filterMux.Unlock()
+
+	f.state.setFilter(peerid.Pretty(), pf.copy())
+
+	select {
+	case sub.filterCh <- struct{}{}:
+	default:
+		// Change is already pending
 	}
 
-	*portsOld = ports
+	return nil
+}
+
+// GetPortFilter returns filter of ports of connected peer, see SetPortFilter
+func (f *Forwarder) GetPortFilter(id string) (PortFilter, error) {
+	peerid, err := f.resolvePeerID(id)
+	if err != nil {
+		return PortFilter{}, err
+	}
+
+	f.portsSubscriptionsMux.Lock()
+	sub := f.portsSubscriptions[peerid]
+	f.portsSubscriptionsMux.Unlock()
+
+	if sub == nil {
+		return PortFilter{}, ErrNotConnected
+	}
+
+	sub.filterMux.Lock()
+	defer sub.filterMux.Unlock()
+
+	return sub.filter.copy(), nil
+}
+
+// ForwardedPort - port of connected peer, which is listened locally.
+// Fallback is true, if requested local port was busy and other one was chosen.
+type ForwardedPort struct {
+	Network    string
+	RemotePort uint16
+	LocalAddr  string
+	Fallback   bool
+}
+
+// ForwardedPorts returns ports of peer with passed id, which are listened locally at the moment
+func (f *Forwarder) ForwardedPorts(id string) ([]ForwardedPort, error) {
+	peerid, err := f.resolvePeerID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f.portsSubscriptionsMux.Lock()
+	sub := f.portsSubscriptions[peerid]
+	f.portsSubscriptionsMux.Unlock()
+
+	if sub == nil {
+		return nil, ErrNotConnected
+	}
+
+	sub.forwardedMux.Lock()
+	ports := make([]ForwardedPort, 0, len(sub.forwarded))
+	for _, fp := range sub.forwarded {
+		ports = append(ports, fp)
+	}
+	sub.forwardedMux.Unlock()
+
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Network != ports[j].Network {
+			return ports[i].Network < ports[j].Network
+		}
+		return ports[i].RemotePort < ports[j].RemotePort
+	})
+
+	return ports, nil
+}
+
+// RemotePort - port, which connected peer offers.
+// Name and Description are empty, if peer did not name port with Service.
+// LocalAddr is empty, if port is not listened locally.
+type RemotePort struct {
+	Network     string
+	Port        uint16
+	Name        string
+	Description string
+	LocalAddr   string
+}
+
+// RemotePorts returns ports, which peer with passed id currently offers
+func (f *Forwarder) RemotePorts(id string) ([]RemotePort, error) {
+	peerid, err := f.resolvePeerID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f.portsSubscriptionsMux.Lock()
+	sub := f.portsSubscriptions[peerid]
+	f.portsSubscriptionsMux.Unlock()
+
+	if sub == nil {
+		return nil, ErrNotConnected
+	}
+
+	return sub.remotePorts(), nil
+}
+
+// receiveManifest passes manifest to goroutine of connection, unless connection is cancelled
+func (sub *connection) receiveManifest(portsM *portsManifest) {
+	select {
+	case sub.subCh <- portsM:
+	case <-sub.ctx.Done():
+	}
+}
+
+// setManifest saves last received manifest and reports, if it differs from previous one
+func (sub *connection) setManifest(portsM *portsManifest) (changed bool) {
+	tcp := sortedPorts(portsM.tcp)
+	udp := sortedPorts(portsM.udp)
+
+	sub.manifestMux.Lock()
+	defer sub.manifestMux.Unlock()
+
+	if sub.manifest != nil && equalPorts(sub.manifest.tcp, tcp) && equalPorts(sub.manifest.udp, udp) &&
+		equalServices(sub.manifest.services, portsM.services) {
+		return false
+	}
+
+	sub.manifest = &portsManifest{tcp: tcp, udp: udp, services: portsM.services}
+
+	return true
+}
+
+func (sub *connection) remotePorts() []RemotePort {
+	sub.manifestMux.Lock()
+	manifest := sub.manifest
+	sub.manifestMux.Unlock()
+
+	if manifest == nil {
+		return []RemotePort{}
+	}
+
+	ports := make([]RemotePort, 0, len(manifest.tcp)+len(manifest.udp))
+
+	remotePort := func(protocolType byte, port uint16) RemotePort {
+		svc := manifest.service(protocolType, port)
+
+		return RemotePort{
+			Network:     networkName(protocolType),
+			Port:        port,
+			Name:        svc.name,
+			Description: svc.description,
+			LocalAddr:   sub.forwarded[forwardedPortKey{protocolType: protocolType, port: port}].LocalAddr,
+		}
+	}
+
+	sub.forwardedMux.Lock()
+	for _, port := range manifest.tcp {
+		ports = append(ports, remotePort(protocolTypeTCP, port))
+	}
+	for _, port := range manifest.udp {
+		ports = append(ports, remotePort(protocolTypeUDP, port))
+	}
+	sub.forwardedMux.Unlock()
+
+	return ports
+}
+
+func sortedPeerIDs(peers map[peer.ID]struct{}) []string {
+	ids := make([]string, 0, len(peers))
+	for peerid := range peers {
+		ids = append(ids, peerid.Pretty())
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+func sortedPorts(ports []uint16) []uint16 {
+	sorted := make([]uint16, len(ports))
+	copy(sorted, ports)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	return sorted
+}
+
+func equalPorts(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalServices(a, b map[forwardedPortKey]portService) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+
+	return true
 }
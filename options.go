@@ -0,0 +1,325 @@
+package p2pforwarder
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var (
+	// ErrInvalidPSK = error "Pre-shared key must be 32 bytes long"
+	ErrInvalidPSK = errors.New("Pre-shared key must be 32 bytes long")
+	// ErrNoTransports = error "At least one transport must be enabled"
+	ErrNoTransports = errors.New("At least one transport must be enabled")
+	// ErrInvalidConnLimits = error "Connection manager low watermark must not be greater than high watermark"
+	ErrInvalidConnLimits = errors.New("Connection manager low watermark must not be greater than high watermark")
+)
+
+// Transport - libp2p transport, which Forwarder can use
+type Transport int
+
+const (
+	// TransportQUIC - QUIC over UDP
+	TransportQUIC Transport = iota
+	// TransportTCP - plain TCP
+	TransportTCP
+	// TransportWebsocket - websocket over TCP
+	TransportWebsocket
+)
+
+// Option - option for NewForwarder
+type Option func(cfg *config) error
+
+type config struct {
+	priv crypto.PrivKey
+
+	psk pnet.PSK
+
+	listenAddrs []string
+	transports  map[Transport]bool
+
+	connMgrLow   int
+	connMgrHigh  int
+	connMgrGrace time.Duration
+
+	bootstrapPeers []peer.AddrInfo
+
+	relaysCustom bool
+	relays       []peer.AddrInfo
+
+	dht  bool
+	mdns bool
+
+	eventHandlers []func(Event)
+
+	ipAllocator ListenIPAllocator
+
+	udpLimits udpLimits
+
+	statePath string // empty, if state is not persisted
+
+	addressBookCustom bool
+	addressBookPath   string // empty, if address book is not persisted
+}
+
+func defaultConfig() *config {
+	return &config{
+		transports: map[Transport]bool{
+			TransportQUIC:      true,
+			TransportTCP:       true,
+			TransportWebsocket: true,
+		},
+
+		connMgrLow:   100,
+		connMgrHigh:  400,
+		connMgrGrace: time.Minute,
+
+		bootstrapPeers: dht.GetDefaultBootstrapPeerAddrInfos(),
+
+		dht: true,
+
+		udpLimits: udpLimits{
+			idleTimeout: DefaultUDPIdleTimeout,
+		},
+	}
+}
+
+// defaultListenAddrs returns listen addresses for every enabled transport
+func (cfg *config) defaultListenAddrs() []string {
+	var addrs []string
+
+	if cfg.transports[TransportQUIC] {
+		addrs = append(addrs,
+			"/ip4/0.0.0.0/udp/0/quic",
+			"/ip6/::/udp/0/quic",
+		)
+	}
+	if cfg.transports[TransportTCP] {
+		addrs = append(addrs,
+			"/ip4/0.0.0.0/tcp/0",
+			"/ip6/::/tcp/0",
+		)
+	}
+	if cfg.transports[TransportWebsocket] {
+		addrs = append(addrs,
+			"/ip4/0.0.0.0/tcp/0/ws",
+			"/ip6/::/tcp/0/ws",
+		)
+	}
+
+	return addrs
+}
+
+// Identity sets private key, which Forwarder's id is derived from.
+// By default key is loaded from (or generated into) user's config directory.
+func Identity(priv crypto.PrivKey) Option {
+	return func(cfg *config) error {
+		cfg.priv = priv
+		return nil
+	}
+}
+
+// IdentityFromFile loads private key from specified file, or generates it there, if file does not exist
+func IdentityFromFile(path string) Option {
+	return func(cfg *config) error {
+		priv, err := loadPrivKey(path)
+		if err != nil {
+			return err
+		}
+
+		cfg.priv = priv
+
+		return nil
+	}
+}
+
+// ListenAddrs replaces default listen multiaddrs, e.g. "/ip4/0.0.0.0/tcp/4001"
+func ListenAddrs(addrs ...string) Option {
+	return func(cfg *config) error {
+		for _, addr := range addrs {
+			_, err := ma.NewMultiaddr(addr)
+			if err != nil {
+				return err
+			}
+		}
+
+		cfg.listenAddrs = addrs
+
+		return nil
+	}
+}
+
+// Transports enables only specified transports. All of them are enabled by default.
+func Transports(transports ...Transport) Option {
+	return func(cfg *config) error {
+		if len(transports) == 0 {
+			return ErrNoTransports
+		}
+
+		cfg.transports = make(map[Transport]bool)
+		for _, t := range transports {
+			cfg.transports[t] = true
+		}
+
+		return nil
+	}
+}
+
+// ConnectionLimits sets connection manager watermarks and grace period
+func ConnectionLimits(low, high int, grace time.Duration) Option {
+	return func(cfg *config) error {
+		if low > high {
+			return ErrInvalidConnLimits
+		}
+
+		cfg.connMgrLow = low
+		cfg.connMgrHigh = high
+		cfg.connMgrGrace = grace
+
+		return nil
+	}
+}
+
+// BootstrapPeers replaces default IPFS bootstrap peers with specified p2p multiaddrs.
+// Without arguments Forwarder does not bootstrap at all.
+func BootstrapPeers(addrs ...string) Option {
+	return func(cfg *config) error {
+		pis, err := parseAddrInfos(addrs)
+		if err != nil {
+			return err
+		}
+
+		cfg.bootstrapPeers = pis
+
+		return nil
+	}
+}
+
+// Relays replaces default static relays with specified p2p multiaddrs.
+// Without arguments relaying is disabled completely.
+func Relays(addrs ...string) Option {
+	return func(cfg *config) error {
+		pis, err := parseAddrInfos(addrs)
+		if err != nil {
+			return err
+		}
+
+		cfg.relaysCustom = true
+		cfg.relays = pis
+
+		return nil
+	}
+}
+
+// PrivateNetwork makes Forwarder talk only to peers, which use the same pre-shared key.
+// Peers without the key can not complete a connection, so public bootstrap peers and relays
+// become unreachable. QUIC transport does not support private networks and is disabled.
+func PrivateNetwork(psk []byte) Option {
+	return func(cfg *config) error {
+		if len(psk) != 32 {
+			return ErrInvalidPSK
+		}
+
+		cfg.psk = pnet.PSK(psk)
+
+		return nil
+	}
+}
+
+// PrivateNetworkFromFile does the same as PrivateNetwork, but loads pre-shared key
+// from swarm key file ("/key/swarm/psk/1.0.0/" format, as used by IPFS)
+func PrivateNetworkFromFile(path string) Option {
+	return func(cfg *config) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		psk, err := pnet.DecodeV1PSK(file)
+		if err != nil {
+			return err
+		}
+
+		cfg.psk = psk
+
+		return nil
+	}
+}
+
+func parseAddrInfos(addrs []string) ([]peer.AddrInfo, error) {
+	maddrs := make([]ma.Multiaddr, len(addrs))
+
+	for i, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		maddrs[i] = maddr
+	}
+
+	return peer.AddrInfosFromP2pAddrs(maddrs...)
+}
+
+// LocalDiscovery enables discovery of peers on the local network via mDNS
+func LocalDiscovery() Option {
+	return func(cfg *config) error {
+		cfg.mdns = true
+		return nil
+	}
+}
+
+// LocalNetworkOnly makes Forwarder work without internet connectivity.
+// Public DHT, bootstrap peers and relays are not used, peers are discovered on the local network via mDNS.
+func LocalNetworkOnly() Option {
+	return func(cfg *config) error {
+		cfg.dht = false
+		cfg.mdns = true
+
+		cfg.bootstrapPeers = nil
+
+		cfg.relaysCustom = true
+		cfg.relays = nil
+
+		return nil
+	}
+}
+
+// EventHandler registers event handler before Forwarder starts, so no event is missed.
+// See Forwarder.OnEvent.
+func EventHandler(fn func(Event)) Option {
+	return func(cfg *config) error {
+		cfg.eventHandlers = append(cfg.eventHandlers, fn)
+		return nil
+	}
+}
+
+// ListenIPAllocation sets allocator of ips, on which ports of connected peers are listened.
+// By default ips are allocated from DefaultListenIPRange and remembered in user's config directory.
+func ListenIPAllocation(a ListenIPAllocator) Option {
+	return func(cfg *config) error {
+		cfg.ipAllocator = a
+		return nil
+	}
+}
+
+// UDPSessionDefaults sets idle timeout of UDP sessions and max number of concurrent UDP sessions
+// per forwarded port, both for our open ports and for listened ports of connected peers.
+// Zero idle timeout disables closing of idle sessions, zero max sessions means no limit.
+// By default idle timeout is DefaultUDPIdleTimeout and number of sessions is not limited.
+func UDPSessionDefaults(idleTimeout time.Duration, maxSessions int) Option {
+	return func(cfg *config) error {
+		cfg.udpLimits = udpLimits{
+			idleTimeout: idleTimeout,
+			maxSessions: maxSessions,
+		}
+		return nil
+	}
+}
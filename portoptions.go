@@ -0,0 +1,82 @@
+package p2pforwarder
+
+import (
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// PortOption - option for Forwarder.OpenPort
+type PortOption func(op *openPort) error
+
+// AllowPeers restricts port to specified peer ids only.
+// Without it port is available to every peer, which is not denied by DenyPeers.
+func AllowPeers(ids ...string) PortOption {
+	return func(op *openPort) error {
+		for _, id := range ids {
+			peerid, err := peer.IDB58Decode(id)
+			if err != nil {
+				return err
+			}
+
+			op.allowedPeers[peerid] = struct{}{}
+		}
+
+		return nil
+	}
+}
+
+// DenyPeers forbids specified peer ids to see and dial port.
+// Denial has priority over AllowPeers.
+func DenyPeers(ids ...string) PortOption {
+	return func(op *openPort) error {
+		for _, id := range ids {
+			peerid, err := peer.IDB58Decode(id)
+			if err != nil {
+				return err
+			}
+
+			op.deniedPeers[peerid] = struct{}{}
+		}
+
+		return nil
+	}
+}
+
+// Target makes connections to opened port to be forwarded to specified host:port,
+// e.g. a database on the local network or a docker container, instead of localhost.
+// Opened port number is only advertised to peers in this case.
+func Target(hostport string) PortOption {
+	return func(op *openPort) error {
+		_, _, err := net.SplitHostPort(hostport)
+		if err != nil {
+			return err
+		}
+
+		op.target = hostport
+
+		return nil
+	}
+}
+
+// Service names port, e.g. "minecraft" or "postgres-staging". Name and description
+// are advertised to peers together with port number, and peers may connect to named services only.
+func Service(name string, description string) PortOption {
+	return func(op *openPort) error {
+		op.service = name
+		op.description = description
+		return nil
+	}
+}
+
+// UDPSessionLimits overrides Forwarder's UDP session defaults for this port, see UDPSessionDefaults
+func UDPSessionLimits(idleTimeout time.Duration, maxSessions int) PortOption {
+	return func(op *openPort) error {
+		op.udpLimits = &udpLimits{
+			idleTimeout: idleTimeout,
+			maxSessions: maxSessions,
+		}
+		return nil
+	}
+}
@@ -3,12 +3,13 @@ package p2pforwarder
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -16,19 +17,92 @@ import (
 	"github.com/pion/udp"
 )
 
-const dialProtID protocol.ID = "/p2pforwarder/dial/1.0.0"
+const (
+	dialProtID protocol.ID = "/p2pforwarder/dial/2.0.0"
+	// dialProtIDv1 does not reply with status
+	dialProtIDv1 protocol.ID = "/p2pforwarder/dial/1.1.0"
+	// dialProtIDLegacy does not reply with status and does not frame UDP datagrams
+	dialProtIDLegacy protocol.ID = "/p2pforwarder/dial/1.0.0"
+)
+
+// Statuses, which dial handler replies with on dialProtID
+const (
+	dialStatusOK byte = iota
+	dialStatusPortClosed
+	dialStatusDenied
+	dialStatusTargetUnreachable
+	dialStatusUnknownProtocol
+	dialStatusLimitReached
+)
+
+var (
+	// ErrRemotePortClosed = error "Port is not opened by peer"
+	ErrRemotePortClosed = errors.New("Port is not opened by peer")
+	// ErrRemoteAccessDenied = error "Peer denied access to port"
+	ErrRemoteAccessDenied = errors.New("Peer denied access to port")
+	// ErrRemoteTargetUnreachable = error "Peer could not reach target of port"
+	ErrRemoteTargetUnreachable = errors.New("Peer could not reach target of port")
+	// ErrRemoteUnknownProtocol = error "Peer does not support requested protocol type"
+	ErrRemoteUnknownProtocol = errors.New("Peer does not support requested protocol type")
+	// ErrRemoteLimitReached = error "Peer's session limit of port reached"
+	ErrRemoteLimitReached = errors.New("Peer's session limit of port reached")
+	// ErrRemoteUnknownStatus = error "Peer replied with unknown status"
+	ErrRemoteUnknownStatus = errors.New("Peer replied with unknown status")
+)
+
+// dialStatusError returns error, which corresponds to status of dial handler
+func dialStatusError(status byte) error {
+	switch status {
+	case dialStatusOK:
+		return nil
+	case dialStatusPortClosed:
+		return ErrRemotePortClosed
+	case dialStatusDenied:
+		return ErrRemoteAccessDenied
+	case dialStatusTargetUnreachable:
+		return ErrRemoteTargetUnreachable
+	case dialStatusUnknownProtocol:
+		return ErrRemoteUnknownProtocol
+	case dialStatusLimitReached:
+		return ErrRemoteLimitReached
+	default:
+		return ErrRemoteUnknownStatus
+	}
+}
 
 var dialsIP = "127.0.88.89"
 
 func setDialHandler(f *Forwarder) {
-	f.host.SetStreamHandler(dialProtID, func(s network.Stream) {
-		onInfoFn("'dial' from " + s.Conn().RemotePeer().Pretty())
+	handler := func(s network.Stream) {
+		peerid := s.Conn().RemotePeer()
+
+		// reply tells status to peers, which support it. Stream is reset, if status is not OK.
+		reply := func(status byte) error {
+			if s.Protocol() != dialProtID {
+				if status != dialStatusOK {
+					s.Reset()
+				}
+				return nil
+			}
+
+			_, err := s.Write([]byte{status})
+			if err != nil {
+				s.Reset()
+				return err
+			}
+
+			if status != dialStatusOK {
+				s.Close()
+			}
+
+			return nil
+		}
 
 		portBytes := make([]byte, 3)
 		_, err := io.ReadFull(s, portBytes)
 		if err != nil {
 			s.Reset()
-			onErrFn(fmt.Errorf("dial handler: %s", err))
+			f.onErr(fmt.Errorf("dial handler: %s", err))
 			return
 		}
 
@@ -47,166 +121,419 @@ func setDialHandler(f *Forwarder) {
 			addr = "tcp:" + strconv.Itoa(portInt)
 
 			portsMap = f.openPorts.tcp
-		case protocolTypeUDP:
+		case protocolTypeUDP, protocolTypeUDPMux:
 			addr = "udp:" + strconv.Itoa(portInt)
 
 			portsMap = f.openPorts.udp
 		default:
-			s.Reset()
+			reply(dialStatusUnknownProtocol)
+			f.onErr(fmt.Errorf("dial handler: unknown protocol type %d from %s", protocolType, peerid.Pretty()))
 			return
 		}
 
-		onInfoFn("Dialing to " + addr + " from " + s.Conn().RemotePeer().Pretty())
-		defer onInfoFn("Closed dial to " + addr + " from " + s.Conn().RemotePeer().Pretty())
-
 		portsMap.mux.Lock()
-		portContext := portsMap.ports[port]
+		op := portsMap.ports[port]
 		portsMap.mux.Unlock()
 
-		if portContext == nil {
-			s.Reset()
+		if op == nil {
+			reply(dialStatusPortClosed)
 			return
 		}
 
-		var conn net.Conn
+		if !op.isAllowed(peerid) {
+			reply(dialStatusDenied)
+			f.onErr(fmt.Errorf("dial handler: %s is not allowed to dial %s", peerid.Pretty(), addr))
+			return
+		}
 
-		switch protocolType {
-		case protocolTypeTCP:
-			conn, err = net.DialTCP("tcp", &net.TCPAddr{
-				IP:   net.ParseIP(dialsIP),
-				Port: 0,
-			}, &net.TCPAddr{
-				IP:   nil,
-				Port: portInt,
-			})
-		case protocolTypeUDP:
-			conn, err = net.DialUDP("udp", &net.UDPAddr{
-				IP:   net.ParseIP(dialsIP),
-				Port: 0,
-			}, &net.UDPAddr{
-				IP:   nil,
-				Port: portInt,
-			})
+		limits := f.udpLimits
+		if op.udpLimits != nil {
+			limits = *op.udpLimits
+		}
+
+		if protocolType == protocolTypeUDP {
+			sessions := atomic.AddInt32(&op.udpSessions, 1)
+			defer atomic.AddInt32(&op.udpSessions, -1)
+
+			if limits.exceeded(sessions - 1) {
+				reply(dialStatusLimitReached)
+				f.emit(EventUDPSessionRefused{
+					PeerID: peerid.Pretty(),
+					Port:   port,
+				})
+				return
+			}
 		}
 
+		f.emit(EventStreamAccepted{
+			PeerID:  peerid.Pretty(),
+			Network: networkName(protocolType),
+			Port:    port,
+			Target:  op.target,
+		})
+		defer f.emit(EventStreamClosed{
+			PeerID:  peerid.Pretty(),
+			Network: networkName(protocolType),
+			Port:    port,
+		})
+
+		if protocolType == protocolTypeUDPMux {
+			err = reply(dialStatusOK)
+			if err != nil {
+				f.onErr(fmt.Errorf("dial handler: %s", err))
+				return
+			}
+
+			f.serveUDPMuxStream(op, s, peerid, port, limits)
+			return
+		}
+
+		conn, err := dialOpenPort(op, protocolType, port)
 		if err != nil {
-			s.Reset()
-			onErrFn(fmt.Errorf("dial handler: %s", err))
+			reply(dialStatusTargetUnreachable)
+			f.onErr(fmt.Errorf("dial handler: %s", err))
 			return
 		}
 
-		pipeBothIOsAndClose(portContext, s, conn)
-	})
-}
+		err = reply(dialStatusOK)
+		if err != nil {
+			conn.Close()
+			f.onErr(fmt.Errorf("dial handler: %s", err))
+			return
+		}
 
-func createAddrInfoString(network string, listenip string, lport int, port int) string {
-	return network + " " + listenip + ":" + strconv.Itoa(lport) + " -> " + strconv.Itoa(port)
-}
+		if protocolType == protocolTypeUDP {
+			idled := f.pipeUDPSession(op.ctx, conn, s, s.Protocol() != dialProtIDLegacy, limits.idleTimeout)
+			if idled {
+				f.emit(EventUDPSessionReaped{
+					PeerID: peerid.Pretty(),
+					Port:   port,
+					Reason: ReapReasonIdle,
+				})
+			}
+			return
+		}
 
-func (f *Forwarder) dial(ctx context.Context, peerid peer.ID, protocolType byte, listenip string, port uint16) {
-	lport := int(port)
+		f.pipeBothIOsAndClose(op.ctx, s, conn)
+	}
 
-	var addressinfostr string
+	f.host.SetStreamHandler(dialProtID, handler)
+	f.host.SetStreamHandler(dialProtIDv1, handler)
+	f.host.SetStreamHandler(dialProtIDLegacy, handler)
+}
 
-	var listenfunc func(lip net.IP, port int) (net.Listener, error)
+// dialOpenPort connects to target of our open port
+func dialOpenPort(op *openPort, protocolType byte, port uint16) (net.Conn, error) {
+	if op.target != "" {
+		return net.Dial(networkName(protocolType), op.target)
+	}
 
 	switch protocolType {
 	case protocolTypeTCP:
-		addressinfostr = createAddrInfoString("tcp", listenip, lport, int(port))
+		return net.DialTCP("tcp", &net.TCPAddr{
+			IP:   net.ParseIP(dialsIP),
+			Port: 0,
+		}, &net.TCPAddr{
+			IP:   nil,
+			Port: int(port),
+		})
+	default:
+		return net.DialUDP("udp", &net.UDPAddr{
+			IP:   net.ParseIP(dialsIP),
+			Port: 0,
+		}, &net.UDPAddr{
+			IP:   nil,
+			Port: int(port),
+		})
+	}
+}
 
-		listenfunc = func(lip net.IP, port int) (net.Listener, error) {
-			return net.ListenTCP("tcp", &net.TCPAddr{
+// dial starts listening for connections to peer's port, it returns as soon as listener is ready.
+// Returned stop closes listener and its connections and returns after port is freed.
+// Listening is stopped as well, when ctx is done.
+func (f *Forwarder) dial(parentCtx context.Context, peerid peer.ID, protocolType byte, sub *connection, port uint16) (stop func()) {
+	networkType := networkName(protocolType)
+
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	onDialErr := func(err error) {
+		f.emit(EventDialFailed{
+			PeerID:  peerid.Pretty(),
+			Network: networkType,
+			Port:    port,
+			Err:     err,
+		})
+	}
+
+	lip := net.ParseIP(sub.listenip)
+	lport := sub.cc.localPort(protocolType, port)
+
+	var (
+		serve   func()
+		closeLn func() error
+	)
+
+	listen := func(lport int) (net.Addr, error) {
+		switch {
+		case protocolType == protocolTypeTCP:
+			ln, err := net.ListenTCP("tcp", &net.TCPAddr{
 				IP:   lip,
-				Port: port,
+				Port: lport,
 			})
-		}
-	case protocolTypeUDP:
-		addressinfostr = createAddrInfoString("udp", listenip, lport, int(port))
+			if err != nil {
+				return nil, err
+			}
 
-		listenfunc = func(lip net.IP, port int) (net.Listener, error) {
-			return udp.Listen("udp", &net.UDPAddr{
+			serve = func() { f.serveListener(ctx, peerid, protocolType, port, ln, onDialErr) }
+			closeLn = ln.Close
+
+			return ln.Addr(), nil
+		case sub.cc.multiplexUDP:
+			pconn, err := net.ListenUDP("udp", &net.UDPAddr{
 				IP:   lip,
-				Port: port,
+				Port: lport,
 			})
+			if err != nil {
+				return nil, err
+			}
+
+			serve = func() { f.serveUDPMux(ctx, peerid, port, pconn, onDialErr) }
+			closeLn = pconn.Close
+
+			return pconn.LocalAddr(), nil
+		default:
+			ln, err := udp.Listen("udp", &net.UDPAddr{
+				IP:   lip,
+				Port: lport,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			serve = func() { f.serveListener(ctx, peerid, protocolType, port, ln, onDialErr) }
+			closeLn = ln.Close
+
+			return ln.Addr(), nil
 		}
 	}
 
-	lip := net.ParseIP(listenip)
+	var (
+		addr net.Addr
+		err  error
+	)
+	if lport > 0 && lport <= 65535 {
+		addr, err = listen(lport)
+	} else {
+		err = fmt.Errorf("local port %d is out of range", lport)
+	}
+	fallback := err != nil
+	if fallback {
+		onDialErr(err)
 
-	ln, err := listenfunc(lip, lport)
-	if err != nil {
-		onErrFn(fmt.Errorf("dial: %s", err))
+		// Letting OS choose free port
+		addr, err = listen(0)
+		if err != nil {
+			onDialErr(err)
+			return cancel
+		}
+	}
 
-		for i := 0; i < 4; i++ {
-			lport = rand.Intn(65535-1024) + 1024
+	fpKey := forwardedPortKey{protocolType: protocolType, port: port}
+	fp := ForwardedPort{
+		Network:    networkType,
+		RemotePort: port,
+		LocalAddr:  addr.String(),
+		Fallback:   fallback,
+	}
 
-			ln, err = listenfunc(lip, lport)
+	sub.forwardedMux.Lock()
+	sub.forwarded[fpKey] = fp
+	sub.forwardedMux.Unlock()
 
-			if err != nil {
-				onErrFn(fmt.Errorf("dial: %s", err))
-			} else {
-				break
+	f.emit(EventListening{
+		PeerID:   peerid.Pretty(),
+		Network:  networkType,
+		Port:     port,
+		Addr:     addr.String(),
+		Fallback: fallback,
+	})
+
+	served := make(chan struct{})
+	go func() {
+		serve()
+		close(served)
+	}()
+
+	var stopOnce sync.Once
+	stop = func() {
+		stopOnce.Do(func() {
+			cancel()
+			closeLn()
+			<-served
+
+			sub.forwardedMux.Lock()
+			// Port could be listened by new listener already
+			if sub.forwarded[fpKey] == fp {
+				delete(sub.forwarded, fpKey)
 			}
-		}
+			sub.forwardedMux.Unlock()
 
+			f.emit(EventListeningStopped{
+				PeerID:  peerid.Pretty(),
+				Network: networkType,
+				Port:    port,
+				Addr:    addr.String(),
+			})
+		})
+	}
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	return stop
+}
+
+// serveListener forwards every connection accepted by ln to peer's port in separate stream.
+// It returns after ctx is done and all connections are closed.
+func (f *Forwarder) serveListener(ctx context.Context, peerid peer.ID, protocolType byte, port uint16, ln net.Listener, onDialErr func(error)) {
+	networkType := networkName(protocolType)
+
+	var (
+		udpSessions int32
+		sessions    sync.WaitGroup
+	)
+	// UDP listener frees its socket only after all its connections are closed
+	defer sessions.Wait()
+
+	// Local clients, which were refused because of session limit. Every datagram of refused client
+	// is accepted by ln again, so refusal is reported once per client.
+	refused := make(map[string]struct{})
+
+loop:
+	for {
+		conn, err := ln.Accept()
 		if err != nil {
-			return
+			select {
+			case <-ctx.Done():
+				break loop
+			default:
+				onDialErr(err)
+				continue loop
+			}
 		}
-	}
 
-	onInfoFn("Listening " + addressinfostr)
+		if protocolType == protocolTypeUDP && f.udpLimits.exceeded(atomic.LoadInt32(&udpSessions)) {
+			conn.Close()
+
+			addr := conn.RemoteAddr().String()
+			if _, ok := refused[addr]; !ok {
+				refused[addr] = struct{}{}
+				f.emit(EventUDPSessionRefused{
+					PeerID: peerid.Pretty(),
+					Port:   port,
+					Addr:   addr,
+				})
+			}
+			continue loop
+		}
 
-	go func() {
-	loop:
-		for {
-			conn, err := ln.Accept()
+		if protocolType == protocolTypeUDP {
+			delete(refused, conn.RemoteAddr().String())
+			atomic.AddInt32(&udpSessions, 1)
+		}
+
+		connInfo := EventConnAccepted{
+			PeerID:     peerid.Pretty(),
+			Network:    networkType,
+			Port:       port,
+			LocalAddr:  ln.Addr().String(),
+			RemoteAddr: conn.RemoteAddr().String(),
+		}
+
+		f.emit(connInfo)
+
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			defer f.emit(EventConnClosed(connInfo))
+			if protocolType == protocolTypeUDP {
+				defer atomic.AddInt32(&udpSessions, -1)
+			}
+
+			s, err := f.newDialStream(ctx, peerid, protocolType, port)
 			if err != nil {
-				onErrFn(fmt.Errorf("dial: %s", err))
-				select {
-				case <-ctx.Done():
-					break loop
-				default:
-					continue loop
+				conn.Close()
+				onDialErr(err)
+				return
+			}
+
+			if protocolType == protocolTypeUDP {
+				idled := f.pipeUDPSession(ctx, conn, s, s.Protocol() != dialProtIDLegacy, f.udpLimits.idleTimeout)
+				if idled {
+					f.emit(EventUDPSessionReaped{
+						PeerID: peerid.Pretty(),
+						Port:   port,
+						Addr:   conn.RemoteAddr().String(),
+						Reason: ReapReasonIdle,
+					})
 				}
+				return
 			}
 
-			onInfoFn("Accepted " + ln.Addr().Network() + " connection from " + conn.RemoteAddr().String() + " on " + ln.Addr().String())
+			f.pipeBothIOsAndClose(ctx, conn, s)
+		}()
+	}
+}
 
-			go func() {
-				defer onInfoFn("Closed " + ln.Addr().Network() + " connection from " + conn.RemoteAddr().String() + " on " + ln.Addr().String())
+// newDialStream opens dial stream to peer's port.
+// If peer supports status replies, it waits for one and returns error, which describes it.
+func (f *Forwarder) newDialStream(ctx context.Context, peerid peer.ID, protocolType byte, port uint16) (network.Stream, error) {
+	s, err := f.host.NewStream(ctx, peerid, dialProtID, dialProtIDv1, dialProtIDLegacy)
+	if err != nil {
+		return nil, err
+	}
 
-				s, err := f.host.NewStream(ctx, peerid, dialProtID)
-				if err != nil {
-					conn.Close()
-					onErrFn(fmt.Errorf("dial: %s", err))
-					return
-				}
+	p := make([]byte, 3)
+	p[0] = protocolType
+	binary.BigEndian.PutUint16(p[1:3], port)
 
-				p := make([]byte, 3)
-				p[0] = protocolType
-				binary.BigEndian.PutUint16(p[1:3], port)
+	_, err = s.Write(p)
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
 
-				_, err = s.Write(p)
-				if err != nil {
-					s.Reset()
-					conn.Close()
-					onErrFn(fmt.Errorf("dial: %s", err))
-					return
-				}
+	if s.Protocol() != dialProtID {
+		return s, nil
+	}
 
-				pipeBothIOsAndClose(ctx, conn, s)
-			}()
-		}
-	}()
+	status := make([]byte, 1)
+	_, err = io.ReadFull(s, status)
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
 
-	<-ctx.Done()
-	ln.Close()
+	err = dialStatusError(status[0])
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
 
-	onInfoFn("Closed " + addressinfostr)
+	return s, nil
 }
 
-// pipeBothIOsAndClose pipes `a` and `b` in both directions and closes them in the end
-func pipeBothIOsAndClose(parentctx context.Context, a io.ReadWriteCloser, b io.ReadWriteCloser) {
+// closeWriter is implemented by *net.TCPConn and network.Stream
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipeBothIOsAndClose pipes `a` and `b` in both directions and closes them in the end.
+// When one direction reaches EOF, write side of receiver is closed, if it supports half-close,
+// so protocols relying on half-closed connections keep working.
+func (f *Forwarder) pipeBothIOsAndClose(parentctx context.Context, a io.ReadWriteCloser, b io.ReadWriteCloser) {
 	ctx, cancel := context.WithCancel(parentctx)
 
 	var wg sync.WaitGroup
@@ -218,22 +545,22 @@ func pipeBothIOsAndClose(parentctx context.Context, a io.ReadWriteCloser, b io.R
 		cancel()
 	}()
 
-	go func() {
-		_, err := io.Copy(b, a)
-		wg.Done()
-		if err != nil {
-			onErrFn(fmt.Errorf("pipeBothIOsAndClose b<-a: %s", err))
-			cancel()
+	pipe := func(dst io.ReadWriteCloser, src io.ReadWriteCloser, name string) {
+		_, err := io.Copy(dst, src)
+		if err == nil {
+			if cw, ok := dst.(closeWriter); ok {
+				err = cw.CloseWrite()
+			}
 		}
-	}()
-	go func() {
-		_, err := io.Copy(a, b)
 		wg.Done()
 		if err != nil {
-			onErrFn(fmt.Errorf("pipeBothIOsAndClose a<-b: %s", err))
+			f.onErr(fmt.Errorf("pipeBothIOsAndClose %s: %s", name, err))
 			cancel()
 		}
-	}()
+	}
+
+	go pipe(b, a, "b<-a")
+	go pipe(a, b, "a<-b")
 
 	<-ctx.Done()
 
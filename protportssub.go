@@ -2,140 +2,293 @@ package p2pforwarder
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
 )
 
-const portssubProtID protocol.ID = "/p2pforwarder/portssub/1.0.0"
+const (
+	// portssubProtID keeps one stream per subscriber open, manifests and pings are sent over it
+	portssubProtID protocol.ID = "/p2pforwarder/portssub/3.0.0"
+	// portssubProtIDv2 sends every manifest in new stream, manifest has the same format as on portssubProtID
+	portssubProtIDv2 protocol.ID = "/p2pforwarder/portssub/2.0.0"
+	// portssubProtIDv1 sends every manifest in new stream and carries manifest without version and room for new fields
+	portssubProtIDv1 protocol.ID = "/p2pforwarder/portssub/1.0.0"
+)
 
+// Modes, which are sent first in every stream
 const (
-	portssubModeManifest  byte = 0x00
+	portssubModeManifest  byte = 0x00 // portssubProtIDv2 and portssubProtIDv1 only
 	portssubModeSubscribe byte = 0x01
 )
 
-type portsManifest struct {
-	tcp []uint16
-	udp []uint16
+// Messages of portssubProtID subscription stream
+const (
+	portssubMsgManifest byte = 0x00 // publisher -> subscriber
+	portssubMsgPing     byte = 0x01 // subscriber -> publisher
+	portssubMsgPong     byte = 0x02 // publisher -> subscriber
+)
+
+const (
+	// portssubPingInterval - how often subscriber pings publisher
+	portssubPingInterval = 15 * time.Second
+	// portssubTimeout - subscription stream is considered dead, if nothing is received during it
+	portssubTimeout = 3 * portssubPingInterval
+
+	// portssubRenewInterval - how often subscription to peers, which don't support portssubProtID, is renewed
+	portssubRenewInterval = 30 * time.Second
+
+	portssubMinBackoff = time.Second
+	portssubMaxBackoff = time.Minute
+
+	// portssubLostAfter - number of failed attempts, after which subscription is reported lost.
+	// Attempts are continued after that with max backoff.
+	portssubLostAfter = 5
+
+	// portssubSendAttempts - number of attempts to send manifest to portssubProtIDv2 or portssubProtIDv1 subscriber,
+	// before it is forgotten
+	portssubSendAttempts = 3
+)
+
+// subscriber - peer, which is subscribed to our open ports
+type subscriber struct {
+	protID protocol.ID
+
+	s        network.Stream // nil for portssubProtIDv2 and portssubProtIDv1 subscribers
+	writeMux sync.Mutex
 }
 
 func setPortsSubHandler(f *Forwarder) {
-	f.host.SetStreamHandler(portssubProtID, func(s network.Stream) {
-		onInfoFn("'portssub' from " + s.Conn().RemotePeer().Pretty())
-
+	handler := func(s network.Stream) {
 		modeBytes := make([]byte, 1)
 		_, err := io.ReadFull(s, modeBytes)
 		if err != nil {
 			s.Reset()
-			onErrFn(fmt.Errorf("portssub handler: %s", err))
+			f.onErr(fmt.Errorf("portssub handler: %s", err))
 			return
 		}
 
 		switch modeBytes[0] {
 		case portssubModeManifest:
 			f.portsSubscriptionsMux.Lock()
-			subCh := f.portsSubscriptions[s.Conn().RemotePeer()]
+			sub := f.portsSubscriptions[s.Conn().RemotePeer()]
 			f.portsSubscriptionsMux.Unlock()
 
-			if subCh == nil {
+			if sub == nil {
 				return
 			}
 
-			portsM, err := readPortsManifest(s)
+			var portsM *portsManifest
+			if s.Protocol() == portssubProtIDv1 {
+				portsM, err = readPortsManifestV1(s)
+			} else {
+				portsM, err = readPortsManifest(s)
+			}
 			if err != nil {
 				s.Reset()
-				onErrFn(err)
+				f.onErr(err)
 				return
 			}
 			_, err = s.Write([]byte{0x01})
 			if err != nil {
 				s.Reset()
-				onErrFn(err)
+				f.onErr(err)
 				return
 			}
 
-			subCh <- portsM
+			sub.receiveManifest(portsM)
 
 		case portssubModeSubscribe:
+			subr := &subscriber{protID: s.Protocol()}
+			if s.Protocol() == portssubProtID {
+				subr.s = s
+			}
+
 			f.portsSubscribersMux.Lock()
-			f.portsSubscribers[s.Conn().RemotePeer()] = struct{}{}
+			old := f.portsSubscribers[s.Conn().RemotePeer()]
+			f.portsSubscribers[s.Conn().RemotePeer()] = subr
 			f.portsSubscribersMux.Unlock()
 
-			b := f.createOpenPortsManifestBytes()
+			if old != nil && old.s != nil {
+				old.s.Reset()
+			}
+
+			f.emit(EventPeerSubscribed{PeerID: s.Conn().RemotePeer().Pretty()})
 
-			f.sendPortsManifestToSubscriber(s.Conn().RemotePeer(), b)
+			f.sendPortsManifestToSubscriber(s.Conn().RemotePeer(), subr)
+
+			if subr.s != nil {
+				f.serveSubscriber(s.Conn().RemotePeer(), subr)
+				return
+			}
 		}
 
 		s.Close()
-	})
+	}
+
+	f.host.SetStreamHandler(portssubProtID, handler)
+	f.host.SetStreamHandler(portssubProtIDv2, handler)
+	f.host.SetStreamHandler(portssubProtIDv1, handler)
 }
 
-func (f *Forwarder) publishOpenPortsManifest() {
-	b := f.createOpenPortsManifestBytes()
+// serveSubscriber answers pings of subscriber, until its stream fails
+func (f *Forwarder) serveSubscriber(peerid peer.ID, subr *subscriber) {
+	msg := make([]byte, 1)
+	for {
+		subr.s.SetReadDeadline(time.Now().Add(portssubTimeout))
+
+		_, err := io.ReadFull(subr.s, msg)
+		if err != nil {
+			break
+		}
+
+		if msg[0] != portssubMsgPing {
+			f.onErr(fmt.Errorf("portssub handler: unknown message %d from %s", msg[0], peerid.Pretty()))
+			break
+		}
 
+		subr.writeMux.Lock()
+		_, err = subr.s.Write([]byte{portssubMsgPong})
+		subr.writeMux.Unlock()
+		if err != nil {
+			break
+		}
+	}
+
+	subr.s.Reset()
+
+	f.portsSubscribersMux.Lock()
+	if f.portsSubscribers[peerid] == subr {
+		delete(f.portsSubscribers, peerid)
+	}
+	f.portsSubscribersMux.Unlock()
+}
+
+func (f *Forwarder) publishOpenPortsManifest() {
 	f.portsSubscribersMux.Lock()
-	for peerid := range f.portsSubscribers {
-		go f.sendPortsManifestToSubscriber(peerid, b)
+	for peerid, subr := range f.portsSubscribers {
+		go f.sendPortsManifestToSubscriber(peerid, subr)
 	}
 	f.portsSubscribersMux.Unlock()
 }
 
-func (f *Forwarder) createOpenPortsManifestBytes() []byte {
+// createOpenPortsManifest creates manifest of open ports, which peerid is allowed to see
+func (f *Forwarder) createOpenPortsManifest(peerid peer.ID) *portsManifest {
 	f.openPorts.tcp.mux.Lock()
 	f.openPorts.udp.mux.Lock()
 
-	lt := len(f.openPorts.tcp.ports)
-	lu := len(f.openPorts.udp.ports)
+	portsM := &portsManifest{
+		tcp: allowedPorts(f.openPorts.tcp, peerid),
+		udp: allowedPorts(f.openPorts.udp, peerid),
+
+		services: make(map[forwardedPortKey]portService),
+	}
 
-	b := make([]byte, 2+lt*2+2+lu*2)
+	addServices(portsM.services, protocolTypeTCP, f.openPorts.tcp, portsM.tcp)
+	addServices(portsM.services, protocolTypeUDP, f.openPorts.udp, portsM.udp)
 
-	var i int
+	f.openPorts.tcp.mux.Unlock()
+	f.openPorts.udp.mux.Unlock()
 
-	binary.BigEndian.PutUint16(b[i:i+2], uint16(lt))
-	i += 2
+	return portsM
+}
 
-	for k := range f.openPorts.tcp.ports {
-		binary.BigEndian.PutUint16(b[i:i+2], k)
-		i += 2
+// createOpenPortsManifestBytes encodes manifest for peerid in format of passed portssub protocol
+func (f *Forwarder) createOpenPortsManifestBytes(peerid peer.ID, protID protocol.ID) []byte {
+	portsM := f.createOpenPortsManifest(peerid)
+
+	if protID == portssubProtIDv1 {
+		return portsM.marshalV1()
 	}
 
-	binary.BigEndian.PutUint16(b[i:i+2], uint16(lu))
-	i += 2
+	return portsM.marshal()
+}
+
+// allowedPorts must be called with portsMap.mux locked
+func allowedPorts(portsMap *openPortsStoreMap, peerid peer.ID) []uint16 {
+	ports := make([]uint16, 0, len(portsMap.ports))
 
-	for k := range f.openPorts.udp.ports {
-		binary.BigEndian.PutUint16(b[i:i+2], k)
-		i += 2
+	for port, op := range portsMap.ports {
+		if op.isAllowed(peerid) {
+			ports = append(ports, port)
+		}
 	}
 
-	f.openPorts.tcp.mux.Unlock()
-	f.openPorts.udp.mux.Unlock()
+	return ports
+}
 
-	return b
+// addServices must be called with portsMap.mux locked
+func addServices(services map[forwardedPortKey]portService, protocolType byte, portsMap *openPortsStoreMap, ports []uint16) {
+	for _, port := range ports {
+		op := portsMap.ports[port]
+		if op.service == "" && op.description == "" {
+			continue
+		}
+
+		services[forwardedPortKey{protocolType: protocolType, port: port}] = portService{
+			name:        op.service,
+			description: op.description,
+		}
+	}
 }
 
-func (f *Forwarder) sendPortsManifestToSubscriber(peerid peer.ID, b []byte) {
-	err := f.sendOpenPortsManifestBytes(peerid, b)
-	if err == nil {
+// sendPortsManifestToSubscriber sends current manifest to subscriber.
+// Subscriber without long-lived stream is forgotten, if every attempt fails, it subscribes again when it renews subscription.
+func (f *Forwarder) sendPortsManifestToSubscriber(peerid peer.ID, subr *subscriber) {
+	if subr.s != nil {
+		subr.writeMux.Lock()
+		defer subr.writeMux.Unlock()
+
+		// Manifest is created under lock, so outdated one is never sent after actual one
+		b := f.createOpenPortsManifestBytes(peerid, subr.protID)
+
+		_, err := subr.s.Write(append([]byte{portssubMsgManifest}, b...))
+		if err != nil {
+			// serveSubscriber forgets subscriber
+			subr.s.Reset()
+		}
 		return
 	}
 
-	onErrFn(err)
+	backoff := portssubMinBackoff
+
+	var err error
+	for i := 0; i < portssubSendAttempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		// Manifest is created on every attempt, so outdated one is not sent
+		b := f.createOpenPortsManifestBytes(peerid, subr.protID)
+
+		err = f.sendOpenPortsManifestBytes(peerid, subr.protID, b)
+		if err == nil {
+			return
+		}
+	}
+
+	f.onErr(err)
 
 	f.portsSubscribersMux.Lock()
-	delete(f.portsSubscribers, peerid)
+	if f.portsSubscribers[peerid] == subr {
+		delete(f.portsSubscribers, peerid)
+	}
 	f.portsSubscribersMux.Unlock()
 }
 
 // ErrConnReset = error Connection reset
 var ErrConnReset = errors.New("Connection reset")
 
-func (f *Forwarder) sendOpenPortsManifestBytes(peerid peer.ID, b []byte) error {
-	s, err := f.host.NewStream(context.Background(), peerid, portssubProtID)
+// sendOpenPortsManifestBytes sends manifest to portssubProtIDv2 or portssubProtIDv1 subscriber in new stream
+func (f *Forwarder) sendOpenPortsManifestBytes(peerid peer.ID, protID protocol.ID, b []byte) error {
+	s, err := f.host.NewStream(context.Background(), peerid, protID)
 	if err != nil {
 		return fmt.Errorf("sendOpenPortsManifestBytes: %s", err)
 	}
@@ -168,41 +321,142 @@ func (f *Forwarder) sendOpenPortsManifestBytes(peerid peer.ID, b []byte) error {
 	return nil
 }
 
-func readPortsManifest(r io.Reader) (portsM *portsManifest, err error) {
-	portsM = new(portsManifest)
-
-	portsM.tcp, err = readPortsInManifest(r)
+// subscribe asks peer to send us manifests of its open ports.
+// Returned stream stays open, if peer supports portssubProtID.
+func (f *Forwarder) subscribe(ctx context.Context, peerid peer.ID) (network.Stream, error) {
+	s, err := f.host.NewStream(ctx, peerid, portssubProtID, portssubProtIDv2, portssubProtIDv1)
 	if err != nil {
-		return
+		return nil, err
 	}
-	portsM.udp, err = readPortsInManifest(r)
+
+	_, err = s.Write([]byte{portssubModeSubscribe})
 	if err != nil {
-		return
+		s.Reset()
+		return nil, err
 	}
 
-	return
+	if s.Protocol() != portssubProtID {
+		s.Close()
+	}
+
+	return s, nil
 }
 
-func readPortsInManifest(r io.Reader) (ports []uint16, err error) {
-	portsNumBytes := make([]byte, 2)
-	_, err = io.ReadFull(r, portsNumBytes)
-	if err != nil {
-		return nil, err
+// serveSubscription receives manifests from subscription stream, until it fails.
+// For peers without portssubProtID it waits, until subscription should be renewed, and returns nil.
+func (f *Forwarder) serveSubscription(ctx context.Context, s network.Stream, sub *connection) error {
+	if s.Protocol() != portssubProtID {
+		select {
+		case <-ctx.Done():
+		case <-time.After(portssubRenewInterval):
+		}
+		return nil
 	}
 
-	portsNum := int(binary.BigEndian.Uint16(portsNumBytes))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	ports = make([]uint16, portsNum)
+	go func() {
+		ticker := time.NewTicker(portssubPingInterval)
+		defer ticker.Stop()
 
-	for i := 0; i < portsNum; i++ {
-		portBytes := make([]byte, 2)
-		_, err = io.ReadFull(r, portBytes)
+		for {
+			select {
+			case <-ctx.Done():
+				s.Reset()
+				return
+			case <-ticker.C:
+			}
+
+			_, err := s.Write([]byte{portssubMsgPing})
+			if err != nil {
+				s.Reset()
+				return
+			}
+		}
+	}()
+
+	msg := make([]byte, 1)
+	for {
+		s.SetReadDeadline(time.Now().Add(portssubTimeout))
+
+		_, err := io.ReadFull(s, msg)
 		if err != nil {
-			return nil, fmt.Errorf("readPortsManifest: %s", err)
+			return err
+		}
+
+		switch msg[0] {
+		case portssubMsgManifest:
+			portsM, err := readPortsManifest(s)
+			if err != nil {
+				return err
+			}
+
+			sub.receiveManifest(portsM)
+		case portssubMsgPong:
+		default:
+			return fmt.Errorf("unknown portssub message %d", msg[0])
+		}
+	}
+}
+
+// keepSubscription serves subscription to peer and renews it with exponential backoff, when it fails
+func (f *Forwarder) keepSubscription(ctx context.Context, peerid peer.ID, sub *connection, s network.Stream) {
+	for {
+		err := f.serveSubscription(ctx, s, sub)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			// Renewing subscription of peer without portssubProtID
+			s, err = f.subscribe(ctx, peerid)
+			if err == nil {
+				continue
+			}
+		}
+
+		f.emit(EventConnectionState{PeerID: peerid.Pretty(), State: ConnStateReconnecting, Err: err})
+
+		s = f.resubscribe(ctx, peerid)
+		if s == nil {
+			return
 		}
 
-		ports[i] = binary.BigEndian.Uint16(portBytes)
+		f.emit(EventConnectionState{PeerID: peerid.Pretty(), State: ConnStateConnected})
 	}
+}
+
+// resubscribe subscribes to peer with exponential backoff, it returns nil, if ctx is done
+func (f *Forwarder) resubscribe(ctx context.Context, peerid peer.ID) network.Stream {
+	var (
+		failures int
+		backoff  = portssubMinBackoff
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
 
-	return ports, nil
+		s, err := f.subscribe(ctx, peerid)
+		if err == nil {
+			return s
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		failures++
+		if failures == portssubLostAfter {
+			f.emit(EventConnectionState{PeerID: peerid.Pretty(), State: ConnStateLost, Err: err})
+		}
+
+		backoff *= 2
+		if backoff > portssubMaxBackoff {
+			backoff = portssubMaxBackoff
+		}
+	}
 }
@@ -0,0 +1,354 @@
+package p2pforwarder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PersistState makes Forwarder remember its open ports and connections in file at path
+// and restore them, when Forwarder is created with this option next time.
+// If path is empty, file "state" in user's config directory is used, next to the keypair.
+// Ports and connections, which are closed after Forwarder's context is done, stay remembered.
+// Use Forwarder.OpenPorts and Forwarder.Connections to find out restored ones.
+func PersistState(path string) Option {
+	return func(cfg *config) error {
+		if path == "" {
+			var err error
+			path, err = configPath("state")
+			if err != nil {
+				return err
+			}
+		}
+
+		cfg.statePath = path
+
+		return nil
+	}
+}
+
+// stateStore - file with open ports and connections, which are restored on start
+type stateStore struct {
+	ctx  context.Context // Forwarder's one
+	path string
+
+	ports       map[stateKey]savedPort
+	connections map[string]savedConnection
+
+	onError func(error)
+
+	mux sync.Mutex
+}
+
+type stateKey struct {
+	network string
+	port    uint16
+}
+
+type savedState struct {
+	Ports       []savedPort       `json:"ports"`
+	Connections []savedConnection `json:"connections"`
+}
+
+type savedPort struct {
+	Network     string          `json:"network"`
+	Port        uint16          `json:"port"`
+	Target      string          `json:"target,omitempty"`
+	Service     string          `json:"service,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Allow       []string        `json:"allow,omitempty"`
+	Deny        []string        `json:"deny,omitempty"`
+	UDPLimits   *savedUDPLimits `json:"udp_limits,omitempty"`
+}
+
+type savedUDPLimits struct {
+	IdleTimeout time.Duration `json:"idle_timeout"`
+	MaxSessions int           `json:"max_sessions"`
+}
+
+type savedConnection struct {
+	ID           string             `json:"id"`
+	ListenIP     string             `json:"listen_ip,omitempty"`
+	Offset       *int               `json:"offset,omitempty"`
+	Map          []savedPortMapping `json:"map,omitempty"`
+	MultiplexUDP bool               `json:"multiplex_udp,omitempty"`
+	TCP          []uint16           `json:"tcp,omitempty"`
+	UDP          []uint16           `json:"udp,omitempty"`
+	Services     []string           `json:"services,omitempty"`
+}
+
+type savedPortMapping struct {
+	Network string `json:"network"`
+	Remote  uint16 `json:"remote"`
+	Local   uint16 `json:"local"`
+}
+
+// loadStateStore reads state file at path, if it exists
+func loadStateStore(ctx context.Context, path string, onError func(error)) (*stateStore, error) {
+	st := &stateStore{
+		ctx:  ctx,
+		path: path,
+
+		onError: onError,
+
+		ports:       make(map[stateKey]savedPort),
+		connections: make(map[string]savedConnection),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state savedState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sp := range state.Ports {
+		st.ports[stateKey{network: sp.Network, port: sp.Port}] = sp
+	}
+	for _, sc := range state.Connections {
+		st.connections[sc.ID] = sc
+	}
+
+	return st, nil
+}
+
+// All methods of stateStore do nothing on nil store, so Forwarder calls them unconditionally
+
+func (st *stateStore) setPort(sp savedPort) {
+	if st == nil {
+		return
+	}
+
+	st.mux.Lock()
+	st.ports[stateKey{network: sp.Network, port: sp.Port}] = sp
+	st.save()
+	st.mux.Unlock()
+}
+
+func (st *stateStore) removePort(network string, port uint16) {
+	if st == nil || st.ctx.Err() != nil {
+		return
+	}
+
+	st.mux.Lock()
+	delete(st.ports, stateKey{network: network, port: port})
+	st.save()
+	st.mux.Unlock()
+}
+
+func (st *stateStore) setConnection(sc savedConnection) {
+	if st == nil {
+		return
+	}
+
+	st.mux.Lock()
+	st.connections[sc.ID] = sc
+	st.save()
+	st.mux.Unlock()
+}
+
+func (st *stateStore) setFilter(id string, pf PortFilter) {
+	if st == nil {
+		return
+	}
+
+	st.mux.Lock()
+	if sc, ok := st.connections[id]; ok {
+		sc.TCP, sc.UDP, sc.Services = pf.TCP, pf.UDP, pf.Services
+		st.connections[id] = sc
+		st.save()
+	}
+	st.mux.Unlock()
+}
+
+func (st *stateStore) removeConnection(id string) {
+	if st == nil || st.ctx.Err() != nil {
+		return
+	}
+
+	st.mux.Lock()
+	delete(st.connections, id)
+	st.save()
+	st.mux.Unlock()
+}
+
+// snapshot must be called with st.mux locked
+func (st *stateStore) snapshot() savedState {
+	state := savedState{
+		Ports:       make([]savedPort, 0, len(st.ports)),
+		Connections: make([]savedConnection, 0, len(st.connections)),
+	}
+	for _, sp := range st.ports {
+		state.Ports = append(state.Ports, sp)
+	}
+	for _, sc := range st.connections {
+		state.Connections = append(state.Connections, sc)
+	}
+
+	sort.Slice(state.Ports, func(i, j int) bool {
+		if state.Ports[i].Network != state.Ports[j].Network {
+			return state.Ports[i].Network < state.Ports[j].Network
+		}
+		return state.Ports[i].Port < state.Ports[j].Port
+	})
+	sort.Slice(state.Connections, func(i, j int) bool {
+		return state.Connections[i].ID < state.Connections[j].ID
+	})
+
+	return state
+}
+
+// save must be called with st.mux locked
+func (st *stateStore) save() {
+	b, err := json.MarshalIndent(st.snapshot(), "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(st.path), os.ModePerm)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(st.path, b, 0600)
+	}
+	if err != nil {
+		st.onError(err)
+	}
+}
+
+func newSavedPort(networkType string, port uint16, op *openPort) savedPort {
+	sp := savedPort{
+		Network:     networkType,
+		Port:        port,
+		Target:      op.target,
+		Service:     op.service,
+		Description: op.description,
+	}
+
+	if len(op.allowedPeers) != 0 {
+		sp.Allow = sortedPeerIDs(op.allowedPeers)
+	}
+	if len(op.deniedPeers) != 0 {
+		sp.Deny = sortedPeerIDs(op.deniedPeers)
+	}
+
+	if op.udpLimits != nil {
+		sp.UDPLimits = &savedUDPLimits{
+			IdleTimeout: op.udpLimits.idleTimeout,
+			MaxSessions: op.udpLimits.maxSessions,
+		}
+	}
+
+	return sp
+}
+
+// options returns options, which open port the same way again
+func (sp savedPort) options() []PortOption {
+	var opts []PortOption
+
+	if sp.Target != "" {
+		opts = append(opts, Target(sp.Target))
+	}
+	if sp.Service != "" || sp.Description != "" {
+		opts = append(opts, Service(sp.Service, sp.Description))
+	}
+	if len(sp.Allow) != 0 {
+		opts = append(opts, AllowPeers(sp.Allow...))
+	}
+	if len(sp.Deny) != 0 {
+		opts = append(opts, DenyPeers(sp.Deny...))
+	}
+	if sp.UDPLimits != nil {
+		opts = append(opts, UDPSessionLimits(sp.UDPLimits.IdleTimeout, sp.UDPLimits.MaxSessions))
+	}
+
+	return opts
+}
+
+func newSavedConnection(id string, cc *connectConfig) savedConnection {
+	sc := savedConnection{
+		ID:           id,
+		MultiplexUDP: cc.multiplexUDP,
+		TCP:          cc.filter.TCP,
+		UDP:          cc.filter.UDP,
+		Services:     cc.filter.Services,
+	}
+
+	if cc.listenIP != nil {
+		sc.ListenIP = cc.listenIP.String()
+	}
+	if cc.offsetMode {
+		offset := cc.portOffset
+		sc.Offset = &offset
+	}
+
+	for key, local := range cc.portsMap {
+		sc.Map = append(sc.Map, savedPortMapping{
+			Network: networkName(key.protocolType),
+			Remote:  key.port,
+			Local:   local,
+		})
+	}
+	sort.Slice(sc.Map, func(i, j int) bool {
+		if sc.Map[i].Network != sc.Map[j].Network {
+			return sc.Map[i].Network < sc.Map[j].Network
+		}
+		return sc.Map[i].Remote < sc.Map[j].Remote
+	})
+
+	return sc
+}
+
+// options returns options, which connect to peer the same way again
+func (sc savedConnection) options() []ConnectOption {
+	var opts []ConnectOption
+
+	if sc.ListenIP != "" {
+		opts = append(opts, ListenIP(sc.ListenIP))
+	}
+	if sc.Offset != nil {
+		opts = append(opts, PortOffset(*sc.Offset))
+	}
+	for _, m := range sc.Map {
+		opts = append(opts, MapPort(m.Network, m.Remote, m.Local))
+	}
+	if sc.MultiplexUDP {
+		opts = append(opts, MultiplexUDP())
+	}
+	opts = append(opts, Filter(PortFilter{TCP: sc.TCP, UDP: sc.UDP, Services: sc.Services}))
+
+	return opts
+}
+
+// restoreState opens remembered ports and connects to remembered peers.
+// Connections are established in background, so peers, which are offline, do not delay start.
+func (f *Forwarder) restoreState() {
+	st := f.state
+
+	st.mux.Lock()
+	state := st.snapshot()
+	st.mux.Unlock()
+
+	for _, sp := range state.Ports {
+		_, err := f.OpenPort(sp.Network, sp.Port, sp.options()...)
+		if err != nil {
+			f.emit(EventError{Err: fmt.Errorf("restoring %s:%d: %s", sp.Network, sp.Port, err)})
+		}
+	}
+
+	for _, sc := range state.Connections {
+		_, _, err := f.Connect(sc.ID, append(sc.options(), KeepRetrying())...)
+		if err != nil {
+			f.emit(EventError{Err: fmt.Errorf("restoring connection to %s: %s", sc.ID, err)})
+		}
+	}
+}
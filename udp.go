@@ -0,0 +1,214 @@
+package p2pforwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDatagramSize - max size of UDP datagram payload
+const maxDatagramSize = 65535
+
+// DefaultUDPIdleTimeout - default time, after which UDP session without any datagrams is closed
+const DefaultUDPIdleTimeout = 3 * time.Minute
+
+type udpLimits struct {
+	idleTimeout time.Duration
+	maxSessions int
+}
+
+// exceeded reports if one more session is not allowed, when there are `sessions` already
+func (l udpLimits) exceeded(sessions int32) bool {
+	return l.maxSessions > 0 && int(sessions) >= l.maxSessions
+}
+
+// ErrDatagramTooLarge = error "Datagram is too large"
+var ErrDatagramTooLarge = errors.New("Datagram is too large")
+
+// writeDatagram writes datagram, prefixed with its 2 bytes length, so it can be read back as a whole
+func writeDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b[:2], uint16(len(p)))
+	copy(b[2:], p)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readDatagram reads datagram written by writeDatagram into buf, which must be at least maxDatagramSize long
+func readDatagram(r io.Reader, buf []byte) (n int, err error) {
+	_, err = io.ReadFull(r, buf[:2])
+	if err != nil {
+		return 0, err
+	}
+
+	n = int(binary.BigEndian.Uint16(buf[:2]))
+
+	_, err = io.ReadFull(r, buf[:n])
+	if err == io.EOF {
+		// Stream ended in the middle of datagram
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// pipeDatagramsAndClose pipes datagrams between `conn`, which reads and writes whole datagrams,
+// and stream `s` in both directions and closes them in the end
+func (f *Forwarder) pipeDatagramsAndClose(parentctx context.Context, conn io.ReadWriteCloser, s io.ReadWriteCloser) {
+	ctx, cancel := context.WithCancel(parentctx)
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if err != io.EOF {
+					f.onErr(fmt.Errorf("pipeDatagramsAndClose s<-conn: %s", err))
+				}
+				cancel()
+				return
+			}
+
+			err = writeDatagram(s, buf[:n])
+			if err != nil {
+				f.onErr(fmt.Errorf("pipeDatagramsAndClose s<-conn: %s", err))
+				cancel()
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := readDatagram(s, buf)
+			if err != nil {
+				if err != io.EOF {
+					f.onErr(fmt.Errorf("pipeDatagramsAndClose conn<-s: %s", err))
+				}
+				cancel()
+				return
+			}
+
+			_, err = conn.Write(buf[:n])
+			if err != nil {
+				f.onErr(fmt.Errorf("pipeDatagramsAndClose conn<-s: %s", err))
+				cancel()
+				return
+			}
+		}
+	}()
+
+	<-ctx.Done()
+
+	conn.Close()
+	s.Close()
+}
+
+// pipeUDPSession pipes UDP session `conn` and stream `s` and closes them in the end.
+// It reports if session was closed because of idle timeout.
+func (f *Forwarder) pipeUDPSession(parentctx context.Context, conn io.ReadWriteCloser, s io.ReadWriteCloser, framed bool, idleTimeout time.Duration) (idled bool) {
+	ctx, cancel, w := watchIdle(parentctx, idleTimeout)
+	defer cancel()
+
+	conn = &idleTouchingRWC{ReadWriteCloser: conn, w: w}
+
+	if framed {
+		f.pipeDatagramsAndClose(ctx, conn, s)
+	} else {
+		f.pipeBothIOsAndClose(ctx, conn, s)
+	}
+
+	return w.isIdle()
+}
+
+type idleWatcher struct {
+	last  int64 // unix nanoseconds of last activity
+	idled int32
+}
+
+func (w *idleWatcher) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+func (w *idleWatcher) isIdle() bool {
+	return atomic.LoadInt32(&w.idled) == 1
+}
+
+// watchIdle returns context, which is cancelled, if there was no activity during timeout.
+// Zero timeout disables watching.
+func watchIdle(parentctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, *idleWatcher) {
+	ctx, cancel := context.WithCancel(parentctx)
+
+	w := &idleWatcher{}
+	w.touch()
+
+	if timeout <= 0 {
+		return ctx, cancel, w
+	}
+
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				idle := time.Since(time.Unix(0, atomic.LoadInt64(&w.last)))
+				if idle >= timeout {
+					atomic.StoreInt32(&w.idled, 1)
+					cancel()
+					return
+				}
+
+				timer.Reset(timeout - idle)
+			}
+		}
+	}()
+
+	return ctx, cancel, w
+}
+
+// idleTouchingRWC reports every read and write to idleWatcher
+type idleTouchingRWC struct {
+	io.ReadWriteCloser
+	w *idleWatcher
+}
+
+func (rwc *idleTouchingRWC) Read(p []byte) (int, error) {
+	n, err := rwc.ReadWriteCloser.Read(p)
+	rwc.w.touch()
+	return n, err
+}
+
+func (rwc *idleTouchingRWC) Write(p []byte) (int, error) {
+	rwc.w.touch()
+	return rwc.ReadWriteCloser.Write(p)
+}
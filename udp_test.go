@@ -0,0 +1,69 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	datagrams := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte{0xab}, maxDatagramSize),
+	}
+
+	var b bytes.Buffer
+	for _, p := range datagrams {
+		err := writeDatagram(&b, p)
+		if err != nil {
+			t.Fatalf("writeDatagram: %s", err)
+		}
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for _, want := range datagrams {
+		n, err := readDatagram(&b, buf)
+		if err != nil {
+			t.Fatalf("readDatagram: %s", err)
+		}
+
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("readDatagram = %d bytes, want %d", n, len(want))
+		}
+	}
+
+	_, err := readDatagram(&b, buf)
+	if err != io.EOF {
+		t.Errorf("readDatagram after last datagram error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWriteDatagramTooLarge(t *testing.T) {
+	var b bytes.Buffer
+
+	err := writeDatagram(&b, make([]byte, maxDatagramSize+1))
+	if err != ErrDatagramTooLarge {
+		t.Errorf("writeDatagram error = %v, want %v", err, ErrDatagramTooLarge)
+	}
+	if b.Len() != 0 {
+		t.Errorf("writeDatagram wrote %d bytes of too large datagram", b.Len())
+	}
+}
+
+func TestReadDatagramTruncated(t *testing.T) {
+	var b bytes.Buffer
+	err := writeDatagram(&b, []byte("hello"))
+	if err != nil {
+		t.Fatalf("writeDatagram: %s", err)
+	}
+	framed := b.Bytes()
+
+	buf := make([]byte, maxDatagramSize)
+	for n := 1; n < len(framed); n++ {
+		_, err := readDatagram(bytes.NewReader(framed[:n]), buf)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("readDatagram of %d of %d bytes error = %v, want %v", n, len(framed), err, io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package p2pforwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ErrUDPMuxNotSupported = error "Peer does not support UDP multiplexing"
+var ErrUDPMuxNotSupported = errors.New("Peer does not support UDP multiplexing")
+
+// writeMuxDatagram writes datagram of flow, prefixed with 4 bytes flow id and 2 bytes length
+func writeMuxDatagram(w io.Writer, flowID uint32, p []byte) error {
+	if len(p) > maxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+
+	b := make([]byte, 6+len(p))
+	binary.BigEndian.PutUint32(b[:4], flowID)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(p)))
+	copy(b[6:], p)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readMuxDatagram reads datagram written by writeMuxDatagram into buf, which must be at least maxDatagramSize long
+func readMuxDatagram(r io.Reader, buf []byte) (flowID uint32, n int, err error) {
+	_, err = io.ReadFull(r, buf[:4])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	flowID = binary.BigEndian.Uint32(buf[:4])
+
+	n, err = readDatagram(r, buf)
+	if err == io.EOF {
+		// Stream ended in the middle of datagram
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return flowID, n, nil
+}
+
+type udpMuxFlow struct {
+	addr *net.UDPAddr // local client, on connecting side
+	conn net.Conn     // socket connected to target, on serving side
+
+	last int64 // unix nanoseconds of last activity
+}
+
+func (fl *udpMuxFlow) touch() {
+	atomic.StoreInt64(&fl.last, time.Now().UnixNano())
+}
+
+func (fl *udpMuxFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&fl.last)))
+}
+
+// reapInterval returns how often idle flows are checked
+func reapInterval(idleTimeout time.Duration) time.Duration {
+	interval := idleTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// serveUDPMux forwards all UDP flows received on pconn to peer's port in one stream
+func (f *Forwarder) serveUDPMux(ctx context.Context, peerid peer.ID, port uint16, pconn *net.UDPConn, onDialErr func(error)) {
+	var (
+		flows      = make(map[uint32]*udpMuxFlow)
+		flowIDs    = make(map[string]uint32)
+		nextFlowID uint32
+
+		// Clients, which were refused because of session limit, every one is reported once
+		refused = make(map[string]struct{})
+
+		s network.Stream
+
+		mux sync.Mutex
+	)
+
+	closeFlow := func(flowID uint32, reason string) {
+		fl := flows[flowID]
+		delete(flows, flowID)
+		delete(flowIDs, fl.addr.String())
+
+		if reason != "" {
+			f.emit(EventUDPSessionReaped{
+				PeerID: peerid.Pretty(),
+				Port:   port,
+				Addr:   fl.addr.String(),
+				Reason: reason,
+			})
+		}
+		f.emit(EventConnClosed{
+			PeerID:     peerid.Pretty(),
+			Network:    "udp",
+			Port:       port,
+			LocalAddr:  pconn.LocalAddr().String(),
+			RemoteAddr: fl.addr.String(),
+		})
+	}
+
+	// Reaping idle flows
+	if f.udpLimits.idleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(reapInterval(f.udpLimits.idleTimeout))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				mux.Lock()
+				for flowID, fl := range flows {
+					if fl.idle() >= f.udpLimits.idleTimeout {
+						closeFlow(flowID, ReapReasonIdle)
+					}
+				}
+				if len(flows) == 0 && s != nil {
+					// Stream is not needed, until new flow appears
+					s.Close()
+					s = nil
+				}
+				mux.Unlock()
+			}
+		}()
+	}
+
+	// Reading datagrams from peer
+	readStream := func(s network.Stream) {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			flowID, n, err := readMuxDatagram(s, buf)
+			if err != nil {
+				s.Reset()
+				return
+			}
+
+			mux.Lock()
+			fl := flows[flowID]
+			mux.Unlock()
+
+			if fl == nil {
+				continue
+			}
+
+			fl.touch()
+
+			_, err = pconn.WriteToUDP(buf[:n], fl.addr)
+			if err != nil {
+				onDialErr(err)
+			}
+		}
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pconn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			default:
+				onDialErr(err)
+			}
+			break
+		}
+
+		mux.Lock()
+
+		flowID, ok := flowIDs[addr.String()]
+		if !ok {
+			if f.udpLimits.exceeded(int32(len(flows))) {
+				mux.Unlock()
+
+				if _, ok := refused[addr.String()]; !ok {
+					refused[addr.String()] = struct{}{}
+					f.emit(EventUDPSessionRefused{
+						PeerID: peerid.Pretty(),
+						Port:   port,
+						Addr:   addr.String(),
+					})
+				}
+				continue
+			}
+			delete(refused, addr.String())
+
+			flowID = nextFlowID
+			nextFlowID++
+
+			flows[flowID] = &udpMuxFlow{addr: addr}
+			flowIDs[addr.String()] = flowID
+
+			f.emit(EventConnAccepted{
+				PeerID:     peerid.Pretty(),
+				Network:    "udp",
+				Port:       port,
+				LocalAddr:  pconn.LocalAddr().String(),
+				RemoteAddr: addr.String(),
+			})
+		}
+		flows[flowID].touch()
+
+		if s == nil {
+			s, err = f.newDialStream(ctx, peerid, protocolTypeUDPMux, port)
+			if err == nil && s.Protocol() == dialProtIDLegacy {
+				s.Reset()
+				err = ErrUDPMuxNotSupported
+			}
+			if err != nil {
+				s = nil
+				mux.Unlock()
+				onDialErr(err)
+				continue
+			}
+
+			go readStream(s)
+		}
+
+		err = writeMuxDatagram(s, flowID, buf[:n])
+		if err != nil {
+			s.Reset()
+			s = nil
+			mux.Unlock()
+			onDialErr(err)
+			continue
+		}
+
+		mux.Unlock()
+	}
+
+	mux.Lock()
+	for flowID := range flows {
+		closeFlow(flowID, "")
+	}
+	if s != nil {
+		s.Close()
+		s = nil
+	}
+	mux.Unlock()
+}
+
+// serveUDPMuxStream demultiplexes UDP flows carried in stream s to separate sockets connected to target of our open port
+func (f *Forwarder) serveUDPMuxStream(op *openPort, s network.Stream, peerid peer.ID, port uint16, limits udpLimits) {
+	ctx, cancel := context.WithCancel(op.ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	var (
+		flows = make(map[uint32]*udpMuxFlow)
+		mux   sync.Mutex
+
+		writeMux sync.Mutex
+	)
+
+	closeFlow := func(flowID uint32, reason string) {
+		fl := flows[flowID]
+		delete(flows, flowID)
+
+		fl.conn.Close()
+		atomic.AddInt32(&op.udpSessions, -1)
+
+		if reason != "" {
+			f.emit(EventUDPSessionReaped{
+				PeerID: peerid.Pretty(),
+				Port:   port,
+				Reason: reason,
+			})
+		}
+	}
+
+	// Reaping idle flows
+	if limits.idleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(reapInterval(limits.idleTimeout))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				mux.Lock()
+				for flowID, fl := range flows {
+					if fl.idle() >= limits.idleTimeout {
+						closeFlow(flowID, ReapReasonIdle)
+					}
+				}
+				mux.Unlock()
+			}
+		}()
+	}
+
+	// Reading replies of target
+	readConn := func(flowID uint32, fl *udpMuxFlow) {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := fl.conn.Read(buf)
+			if err != nil {
+				return
+			}
+
+			fl.touch()
+
+			writeMux.Lock()
+			err = writeMuxDatagram(s, flowID, buf[:n])
+			writeMux.Unlock()
+			if err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+
+	rejected := make(map[uint32]struct{})
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		flowID, n, err := readMuxDatagram(s, buf)
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case <-ctx.Done():
+				default:
+					f.onErr(fmt.Errorf("dial handler: %s", err))
+				}
+			}
+			break
+		}
+
+		mux.Lock()
+
+		fl := flows[flowID]
+		if fl == nil {
+			sessions := atomic.AddInt32(&op.udpSessions, 1)
+			if limits.exceeded(sessions - 1) {
+				atomic.AddInt32(&op.udpSessions, -1)
+				mux.Unlock()
+
+				if _, ok := rejected[flowID]; !ok {
+					rejected[flowID] = struct{}{}
+					f.emit(EventUDPSessionRefused{
+						PeerID: peerid.Pretty(),
+						Port:   port,
+					})
+				}
+				continue
+			}
+			delete(rejected, flowID)
+
+			conn, err := dialOpenPort(op, protocolTypeUDP, port)
+			if err != nil {
+				atomic.AddInt32(&op.udpSessions, -1)
+				mux.Unlock()
+				f.onErr(fmt.Errorf("dial handler: %s", err))
+				continue
+			}
+
+			fl = &udpMuxFlow{conn: conn}
+			flows[flowID] = fl
+
+			go readConn(flowID, fl)
+		}
+		fl.touch()
+
+		mux.Unlock()
+
+		_, err = fl.conn.Write(buf[:n])
+		if err != nil {
+			f.onErr(fmt.Errorf("dial handler: %s", err))
+		}
+	}
+
+	cancel()
+
+	mux.Lock()
+	for flowID := range flows {
+		closeFlow(flowID, "")
+	}
+	mux.Unlock()
+}
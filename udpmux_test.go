@@ -0,0 +1,72 @@
+package p2pforwarder
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMuxDatagramRoundTrip(t *testing.T) {
+	datagrams := []struct {
+		flowID uint32
+		p      []byte
+	}{
+		{0, []byte("hello")},
+		{1, []byte{}},
+		{0xffffffff, bytes.Repeat([]byte{0xab}, maxDatagramSize)},
+	}
+
+	var b bytes.Buffer
+	for _, d := range datagrams {
+		err := writeMuxDatagram(&b, d.flowID, d.p)
+		if err != nil {
+			t.Fatalf("writeMuxDatagram: %s", err)
+		}
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for _, want := range datagrams {
+		flowID, n, err := readMuxDatagram(&b, buf)
+		if err != nil {
+			t.Fatalf("readMuxDatagram: %s", err)
+		}
+
+		if flowID != want.flowID || !bytes.Equal(buf[:n], want.p) {
+			t.Errorf("readMuxDatagram = flow %d, %d bytes, want flow %d, %d bytes", flowID, n, want.flowID, len(want.p))
+		}
+	}
+
+	_, _, err := readMuxDatagram(&b, buf)
+	if err != io.EOF {
+		t.Errorf("readMuxDatagram after last datagram error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWriteMuxDatagramTooLarge(t *testing.T) {
+	var b bytes.Buffer
+
+	err := writeMuxDatagram(&b, 1, make([]byte, maxDatagramSize+1))
+	if err != ErrDatagramTooLarge {
+		t.Errorf("writeMuxDatagram error = %v, want %v", err, ErrDatagramTooLarge)
+	}
+	if b.Len() != 0 {
+		t.Errorf("writeMuxDatagram wrote %d bytes of too large datagram", b.Len())
+	}
+}
+
+func TestReadMuxDatagramTruncated(t *testing.T) {
+	var b bytes.Buffer
+	err := writeMuxDatagram(&b, 7, []byte("hello"))
+	if err != nil {
+		t.Fatalf("writeMuxDatagram: %s", err)
+	}
+	framed := b.Bytes()
+
+	buf := make([]byte, maxDatagramSize)
+	for n := 1; n < len(framed); n++ {
+		_, _, err := readMuxDatagram(bytes.NewReader(framed[:n]), buf)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("readMuxDatagram of %d of %d bytes error = %v, want %v", n, len(framed), err, io.ErrUnexpectedEOF)
+		}
+	}
+}